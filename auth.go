@@ -0,0 +1,209 @@
+package gorfb
+
+import (
+	"crypto/des"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+type (
+	// Option configures a server created with Server.
+	Option func(serv *RfbServer)
+	// Authenticator handles a security type of the RFB protocol.
+	Authenticator interface {
+		// SecurityType returns the number of the security type.
+		SecurityType() uint8
+		// Authenticate does the handshake of the security type on
+		// conn, after the client chose it. It returns the connection
+		// to use from now on, which may be conn itself, and the
+		// identity of the client, which is attached to the client.
+		// On failure, the text of the error is sent to the client as
+		// the reason, over the returned connection or conn if nil.
+		Authenticate(conn net.Conn) (net.Conn, interface{}, error)
+	}
+	// NoAuth is the None security type, which accepts every client.
+	NoAuth struct{}
+	// VNCAuth is the VNC Authentication security type: a DES
+	// challenge-response with the password returned by Password.
+	VNCAuth struct {
+		Password PasswordFunc
+	}
+	// PasswordFunc returns the password, which the client connected
+	// through conn has to know, or false to refuse the client.
+	PasswordFunc func(conn net.Conn) (string, bool)
+)
+
+const (
+	securityNone    = 1
+	securityVNCAuth = 2
+)
+
+var errAuthFailed = errors.New("Authentication failed")
+
+// Authenticators offers the security types a to the clients, in order of
+// preference. It may be given several times, e.g. along with Password.
+// Without any, clients do not have to authenticate.
+func Authenticators(a ...Authenticator) Option {
+	return func(serv *RfbServer) {
+		serv.auths = append(serv.auths, a...)
+	}
+}
+
+// Password makes clients authenticate with VNC Authentication, using pw.
+// Only the first 8 characters of pw are used.
+func Password(pw string) Option {
+	return PasswordCallback(func(net.Conn) (string, bool) {
+		return pw, true
+	})
+}
+
+// PasswordCallback makes clients authenticate with VNC Authentication,
+// using the password returned by f for each connection. Server fails, if f
+// is nil.
+func PasswordCallback(f PasswordFunc) Option {
+	return Authenticators(VNCAuth{f})
+}
+
+func (NoAuth) SecurityType() uint8 {
+	return securityNone
+}
+
+func (NoAuth) Authenticate(conn net.Conn) (net.Conn, interface{}, error) {
+	return conn, nil, nil
+}
+
+func (VNCAuth) SecurityType() uint8 {
+	return securityVNCAuth
+}
+
+// Authenticate does the VNC Authentication challenge-response with the
+// client.
+func (a VNCAuth) Authenticate(conn net.Conn) (net.Conn, interface{}, error) {
+	challenge := make([]byte, 16)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, nil, err
+	}
+	if _, err := conn.Write(challenge); err != nil {
+		return nil, nil, err
+	}
+	response := make([]byte, 16)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, nil, err
+	}
+	if a.Password == nil {
+		return nil, nil, errAuthFailed
+	}
+	password, ok := a.Password(conn)
+	if !ok {
+		return nil, nil, errAuthFailed
+	}
+	want, err := vncAuthResponse(challenge, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	if subtle.ConstantTimeCompare(response, want) != 1 {
+		return nil, nil, errAuthFailed
+	}
+	return conn, nil, nil
+}
+
+// checkAuths reports the Authenticators, which can not authenticate any
+// client.
+func checkAuths(auths []Authenticator) error {
+	for _, a := range auths {
+		switch a := a.(type) {
+		case VNCAuth:
+			if a.Password == nil {
+				return errors.New("VNC Authentication without a password")
+			}
+		case *VNCAuth:
+			if a == nil || a.Password == nil {
+				return errors.New("VNC Authentication without a password")
+			}
+		}
+	}
+	return nil
+}
+
+// securityTypes returns the numbers of the security types auths.
+func securityTypes(auths []Authenticator) []uint8 {
+	types := make([]uint8, len(auths))
+	for i, a := range auths {
+		types[i] = a.SecurityType()
+	}
+	return types
+}
+
+// authenticate does the handshake of the security type chosen by the
+// client, using the protocol version 3.minor. On success the client uses
+// the returned connection from then on.
+func (client *RfbClient) authenticate(chosen uint8, minor int) error {
+	conn := client.conn
+	for _, a := range client.auths {
+		if a.SecurityType() != chosen {
+			continue
+		}
+		c, identity, err := a.Authenticate(conn)
+		if c != nil {
+			conn = c
+		}
+		if err != nil {
+			securityFailed(conn, minor, err.Error())
+			return err
+		}
+		client.conn = conn
+		client.identity = identity
+		return nil
+	}
+	err := fmt.Errorf("Unsupported security type %v", chosen)
+	securityFailed(conn, minor, err.Error())
+	return err
+}
+
+// securityFailed sends a failed SecurityResult, which has a reason since
+// protocol version 3.8.
+func securityFailed(conn net.Conn, minor int, reason string) {
+	conn.Write(makeHandshake(1))
+	if minor == 8 {
+		reasonmsg(conn, reason)
+	}
+}
+
+// Identity returns the identity of the client, as returned by the
+// Authenticator of its security type.
+func (client *RfbClient) Identity() interface{} {
+	return client.identity
+}
+
+// vncAuthKey returns the DES key for password: the first 8 bytes, padded
+// with zeros, with the bits of every byte reversed.
+func vncAuthKey(password string) []byte {
+	key := make([]byte, 8)
+	copy(key, password)
+	for i, b := range key {
+		var r byte
+		for j := uint(0); j < 8; j++ {
+			r |= (b >> j & 1) << (7 - j)
+		}
+		key[i] = r
+	}
+	return key
+}
+
+// vncAuthResponse returns the challenge encrypted with password, as the
+// client is expected to answer.
+func vncAuthResponse(challenge []byte, password string) ([]byte, error) {
+	c, err := des.NewCipher(vncAuthKey(password))
+	if err != nil {
+		return nil, err
+	}
+	res := make([]byte, len(challenge))
+	for i := 0; i < len(challenge); i += des.BlockSize {
+		c.Encrypt(res[i:], challenge[i:])
+	}
+	return res, nil
+}
@@ -0,0 +1,34 @@
+package gorfb
+
+// bell rings the bell of the client target, or of all clients if target is
+// nil.
+type bell struct {
+	target *connState
+}
+
+func (b bell) apply(state *updaterState) {
+	state.msgs = append(state.msgs, b)
+}
+
+func (b bell) track(t *tracker) {
+	if b.target == nil || b.target == t.conn {
+		t.out = append(t.out, []byte{bellMsg})
+	}
+}
+
+// Bell rings the bell of all clients. Like the other server messages, it is
+// sent between framebuffer updates.
+func (serv *RfbServer) Bell() {
+	select {
+	case <-serv.done:
+	case serv.ctl <- bell{}:
+	}
+}
+
+// Bell rings the bell of the client, between framebuffer updates.
+func (client *RfbClient) Bell() {
+	select {
+	case <-client.done:
+	case client.ctl <- bell{client.state}:
+	}
+}
@@ -0,0 +1,322 @@
+package gorfb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+type (
+	// Clipboard holds the clipboard contents in the formats of the
+	// Extended Clipboard extension. Empty formats are not available.
+	Clipboard struct {
+		Text string
+		RTF  string
+		HTML string
+	}
+	// ClipboardEvent reports the clipboard contents of a client, which
+	// uses the Extended Clipboard extension.
+	ClipboardEvent struct {
+		Clipboard
+		Client *RfbClient
+	}
+	setClipboard struct {
+		c      Clipboard
+		target *connState
+	}
+	clipboardOn struct{}
+	// clipboardMsg sets the server clipboard of the client target, or of
+	// all clients if target is nil. The client is told about it, if
+	// offer is set.
+	clipboardMsg struct {
+		c      *Clipboard
+		policy CutTextPolicy
+		target *connState
+		offer  bool
+	}
+	// clientClipboard is an Extended Clipboard message of the client,
+	// other than provide.
+	clientClipboard struct {
+		flags uint32
+		sizes []uint32
+	}
+)
+
+const encodingExtendedClipboard = -0x3f5e1a32 // 0xc0a1e5ce
+
+// Extended Clipboard formats
+const (
+	clipText    = 1 << 0
+	clipRTF     = 1 << 1
+	clipHTML    = 1 << 2
+	clipFormats = 0xffff
+)
+
+// Extended Clipboard actions
+const (
+	clipCaps    = 1 << 24
+	clipRequest = 1 << 25
+	clipPeek    = 1 << 26
+	clipNotify  = 1 << 27
+	clipProvide = 1 << 28
+)
+
+// Clipboard contents larger than this are dropped.
+const maxClipboardSize = 1 << 20
+
+var errTooLarge = errors.New("clipboard contents too large")
+
+// formats returns the flags of the available formats.
+func (c *Clipboard) formats() uint32 {
+	var f uint32
+	if c == nil {
+		return 0
+	}
+	if c.Text != "" {
+		f |= clipText
+	}
+	if c.RTF != "" {
+		f |= clipRTF
+	}
+	if c.HTML != "" {
+		f |= clipHTML
+	}
+	return f
+}
+
+// field returns the contents of the format f.
+func (c *Clipboard) field(f uint32) *string {
+	switch f {
+	case clipText:
+		return &c.Text
+	case clipRTF:
+		return &c.RTF
+	case clipHTML:
+		return &c.HTML
+	}
+	return nil
+}
+
+// extendedCutText returns an Extended Clipboard message, which is a
+// ServerCutText message with a negative length.
+func extendedCutText(flags uint32, data []byte) []byte {
+	b := make([]byte, 12+len(data))
+	b[0] = serverCutTextMsg
+	binary.BigEndian.PutUint32(b[4:8], uint32(-int32(4+len(data))))
+	binary.BigEndian.PutUint32(b[8:12], flags)
+	copy(b[12:], data)
+	return b
+}
+
+// provide returns the provide message for the formats of c, which fit the
+// size limits of the client.
+func (c *Clipboard) provide(formats uint32, sizes []uint32) []byte {
+	var data bytes.Buffer
+	var flags uint32
+	zw := zlib.NewWriter(&data)
+	b := make([]byte, 4)
+	for i := uint(0); i < 16; i++ {
+		f := uint32(1) << i
+		s := c.field(f)
+		if formats&f == 0 || s == nil || *s == "" {
+			continue
+		}
+		v := *s
+		if f == clipText {
+			v = strings.Replace(v, "\r\n", "\n", -1)
+			v = strings.Replace(v, "\n", "\r\n", -1)
+		}
+		v += "\x00"
+		if int(i) < len(sizes) && uint32(len(v)) > sizes[i] {
+			continue
+		}
+		flags |= f
+		binary.BigEndian.PutUint32(b, uint32(len(v)))
+		zw.Write(b)
+		io.WriteString(zw, v)
+	}
+	zw.Close()
+	return extendedCutText(clipProvide|flags, data.Bytes())
+}
+
+// decodeProvide returns the contents of a provide message with the given
+// formats. Larger formats than maxClipboardSize fail.
+func decodeProvide(formats uint32, data []byte) (Clipboard, error) {
+	var c Clipboard
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return c, err
+	}
+	defer zr.Close()
+	b := make([]byte, 4)
+	for i := uint(0); i < 16; i++ {
+		f := uint32(1) << i
+		if formats&f == 0 {
+			continue
+		}
+		if _, err := io.ReadFull(zr, b); err != nil {
+			return c, err
+		}
+		n := binary.BigEndian.Uint32(b)
+		if n > maxClipboardSize {
+			return c, errTooLarge
+		}
+		v := make([]byte, n)
+		if _, err := io.ReadFull(zr, v); err != nil {
+			return c, err
+		}
+		if s := c.field(f); s != nil {
+			*s = strings.TrimRight(string(v), "\x00")
+			if f == clipText {
+				*s = strings.Replace(*s, "\r\n", "\n", -1)
+			}
+		}
+	}
+	return c, nil
+}
+
+// sendCaps announces the Extended Clipboard extension to the client, once
+// it supports it.
+func (t *tracker) sendCaps() {
+	if !t.clipOn || t.capsSent || !t.choice.has(encodingExtendedClipboard) {
+		return
+	}
+	t.capsSent = true
+	data := make([]byte, 12)
+	for i := 0; i < 3; i++ {
+		binary.BigEndian.PutUint32(data[4*i:], maxClipboardSize)
+	}
+	flags := uint32(clipCaps | clipRequest | clipPeek | clipNotify | clipProvide |
+		clipText | clipRTF | clipHTML)
+	t.out = append(t.out, extendedCutText(flags, data))
+}
+
+// offerClipboard tells the client about the server clipboard: with a
+// notify or provide message if the client sent its Extended Clipboard
+// capabilities, or with a ServerCutText message otherwise.
+func (t *tracker) offerClipboard() {
+	formats := t.clip.formats() & t.clientCaps
+	switch {
+	case t.clientCaps&clipNotify != 0:
+		t.out = append(t.out, extendedCutText(clipNotify|formats, nil))
+	case t.clientCaps&clipProvide != 0:
+		t.out = append(t.out, t.clip.provide(formats, t.clientSizes))
+	case t.clip.Text != "":
+		if txt, ok := encodeLatin1(t.clip.Text, t.clipPolicy); ok {
+			t.out = append(t.out, serverCutText(txt))
+		}
+	}
+}
+
+func (m setClipboard) apply(state *updaterState) {
+	msg := clipboardMsg{&m.c, state.cutTextPolicy, m.target, true}
+	if m.target == nil {
+		state.clipboard = msg
+	}
+	state.msgs = append(state.msgs, msg)
+}
+
+func (clipboardOn) apply(state *updaterState) {
+	state.clipOn = true
+	state.msgs = append(state.msgs, clipboardOn{})
+}
+
+func (clipboardOn) track(t *tracker) {
+	t.clipOn = true
+	t.sendCaps()
+}
+
+func (m clipboardMsg) track(t *tracker) {
+	if m.target != nil && m.target != t.conn {
+		return
+	}
+	t.clip = m.c
+	t.clipPolicy = m.policy
+	if m.offer {
+		t.offerClipboard()
+	}
+}
+
+func (m clientClipboard) track(t *tracker) {
+	switch {
+	case m.flags&clipCaps != 0:
+		t.clientCaps = m.flags
+		t.clientSizes = m.sizes
+	case m.flags&clipRequest != 0:
+		if t.clip != nil && t.clientCaps&clipProvide != 0 {
+			t.out = append(t.out, t.clip.provide(m.flags&clipFormats, t.clientSizes))
+		}
+	case m.flags&clipPeek != 0:
+		if t.clientCaps&clipNotify != 0 {
+			t.out = append(t.out, extendedCutText(clipNotify|t.clip.formats(), nil))
+		}
+	case m.flags&clipNotify != 0:
+		// Ask for the new clipboard contents of the client.
+		want := m.flags & (clipText | clipRTF | clipHTML)
+		if want != 0 && t.clientCaps&clipRequest != 0 {
+			t.out = append(t.out, extendedCutText(clipRequest|want, nil))
+		}
+	}
+}
+
+// decodeClientClipboard decodes the flags and, for caps, the size limits
+// of an Extended Clipboard message.
+func decodeClientClipboard(b []byte) clientClipboard {
+	m := clientClipboard{flags: binary.BigEndian.Uint32(b)}
+	if m.flags&clipCaps == 0 {
+		return m
+	}
+	b = b[4:]
+	for i := uint(0); i < 16; i++ {
+		var n uint32
+		if m.flags&(1<<i) != 0 && len(b) >= 4 {
+			n = binary.BigEndian.Uint32(b)
+			b = b[4:]
+		}
+		m.sizes = append(m.sizes, n)
+	}
+	return m
+}
+
+func (ev ClipboardEvent) work(state *rfbMuxState, done <-chan interface{}) {
+	select {
+	case <-done:
+	case state.clip <- ev:
+	}
+}
+
+// ExtendedClipboard enables the Extended Clipboard extension, which
+// transfers the clipboard as UTF-8 text, RTF or HTML. The clipboard
+// contents of clients using it are reported through the returned
+// channel, which has to be read from then on, while the other clients
+// keep using Txt.
+func (serv *RfbServer) ExtendedClipboard() <-chan ClipboardEvent {
+	serv.clipOnce.Do(func() {
+		close(serv.clipOn)
+		select {
+		case <-serv.done:
+		case serv.ctl <- clipboardOn{}:
+		}
+	})
+	return serv.clip
+}
+
+// SetClipboard sets the clipboard of all clients to c. Clients without the
+// Extended Clipboard extension only get the text.
+func (serv *RfbServer) SetClipboard(c Clipboard) {
+	select {
+	case <-serv.done:
+	case serv.ctl <- setClipboard{c, nil}:
+	}
+}
+
+// SetClipboard sets the clipboard of the client to c.
+func (client *RfbClient) SetClipboard(c Clipboard) {
+	select {
+	case <-client.done:
+	case client.ctl <- setClipboard{c, client.state}:
+	}
+}
@@ -0,0 +1,128 @@
+package gorfb
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/color/palette"
+)
+
+type (
+	// colorMap maps colours onto the indices of a palette, which is sent
+	// to clients with a non-true-colour pixel format.
+	colorMap struct {
+		pal   color.Palette
+		cache map[color.RGBA64]uint32
+	}
+	setPalette color.Palette
+)
+
+// The colour cache of a colorMap is cleared, when it exceeds this size.
+const maxColorCacheSize = 1 << 16
+
+func newColorMap(pal color.Palette) *colorMap {
+	return &colorMap{pal, make(map[color.RGBA64]uint32)}
+}
+
+func (m *colorMap) index(c color.Color) uint32 {
+	r, g, b, a := c.RGBA()
+	key := color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)}
+	if i, ok := m.cache[key]; ok {
+		return i
+	}
+	i := uint32(m.pal.Index(key))
+	if len(m.cache) >= maxColorCacheSize {
+		m.cache = make(map[color.RGBA64]uint32)
+	}
+	m.cache[key] = i
+	return i
+}
+
+// encode returns a SetColorMapEntries message for the whole palette.
+func (m *colorMap) encode() []byte {
+	b := make([]byte, 6+6*len(m.pal))
+	b[0] = setColorMapEntriesMsg
+	binary.BigEndian.PutUint16(b[2:4], 0)
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(m.pal)))
+	for i, c := range m.pal {
+		r, g, b1, _ := c.RGBA()
+		binary.BigEndian.PutUint16(b[6+6*i:], uint16(r))
+		binary.BigEndian.PutUint16(b[8+6*i:], uint16(g))
+		binary.BigEndian.PutUint16(b[10+6*i:], uint16(b1))
+	}
+	return b
+}
+
+func samePalette(a, b color.Palette) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		r1, g1, b1, a1 := a[i].RGBA()
+		r2, g2, b2, a2 := b[i].RGBA()
+		if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+			return false
+		}
+	}
+	return true
+}
+
+// currentPalette returns the palette used for colour map clients: the one
+// set with SetPalette, the one of a paletted framebuffer, or palette.Plan9.
+func (state *updaterState) currentPalette() color.Palette {
+	if state.palette != nil {
+		return state.palette
+	}
+	if p, ok := state.img.(*image.Paletted); ok && len(p.Palette) > 0 {
+		return p.Palette
+	}
+	return palette.Plan9
+}
+
+// updateColorMap checks whether the palette changed since the last call,
+// and returns true in that case.
+func (state *updaterState) updateColorMap() bool {
+	pal := state.currentPalette()
+	if state.pal != nil && samePalette(pal, state.pal) {
+		return false
+	}
+	state.pal = append(color.Palette{}, pal...)
+	state.colorMaps = make(map[int]*colorMap)
+	return true
+}
+
+// colorMap returns the colour map for clients using the pixel format f.
+// The palette is truncated to the number of colours f can index.
+func (state *updaterState) colorMap(f PixelFormat) *colorMap {
+	n := len(state.pal)
+	if max := 1 << f.depth; n > max {
+		n = max
+	}
+	if n > 0xffff {
+		n = 0xffff
+	}
+	m, ok := state.colorMaps[n]
+	if !ok {
+		m = newColorMap(state.pal[:n])
+		state.colorMaps[n] = m
+	}
+	return m
+}
+
+func (p setPalette) apply(state *updaterState) {
+	state.palette = append(color.Palette{}, p...)
+	if p == nil {
+		state.palette = nil
+	}
+}
+
+// SetPalette sets the colour map sent to clients, which requested a
+// non-true-colour pixel format. Framebuffer colours are mapped onto the
+// closest palette entry. A nil palette reverts to the palette of an
+// *image.Paletted framebuffer, or to palette.Plan9 for other images.
+func (serv *RfbServer) SetPalette(p color.Palette) {
+	select {
+	case <-serv.done:
+	case serv.ctl <- setPalette(p):
+	}
+}
@@ -0,0 +1,83 @@
+package gorfb
+
+import (
+	"encoding/binary"
+	"image"
+)
+
+// move records, that the pixels of src were copied to dst.
+type move struct {
+	src image.Rectangle
+	dst image.Point
+}
+
+// A client is only sent this many moves at once, further moves are
+// converted into dirty regions.
+const maxMoves = 16
+
+func (m move) dstRect() image.Rectangle {
+	return m.src.Add(m.dst.Sub(m.src.Min))
+}
+
+// clip restricts the move to the parts of src and dst within bounds.
+func (m move) clip(bounds image.Rectangle) move {
+	d := m.dst.Sub(m.src.Min)
+	src := m.src.Intersect(bounds).Add(d).Intersect(bounds).Sub(d)
+	return move{src, src.Min.Add(d)}
+}
+
+// encode returns a CopyRect rectangle.
+func (m move) encode() [][]byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint16(b[0:2], uint16(m.src.Min.X))
+	binary.BigEndian.PutUint16(b[2:4], uint16(m.src.Min.Y))
+	return [][]byte{rectHeader(m.dstRect(), encodingCopyrect), b}
+}
+
+// move queues m for the client. The destination of pixels, which the
+// client did not receive yet, stays dirty. Clients without CopyRect
+// support, and clients with too many pending moves, get the destination
+// as a dirty region, as do letterboxed clients, if the move exceeds their
+// framebuffer.
+func (t *tracker) move(m move) {
+	if !t.choice.has(encodingCopyrect) || len(t.moves) >= maxMoves || m.clip(t.size) != m {
+		t.dirty = t.dirty.add(m.dstRect())
+		return
+	}
+	d := m.dst.Sub(m.src.Min)
+	for _, r := range t.dirty.toRects() {
+		if stale := r.Intersect(m.src); !stale.Empty() {
+			t.dirty = t.dirty.add(stale.Add(d))
+		}
+	}
+	t.moves = append(t.moves, m)
+}
+
+func (msg damage) track(t *tracker) {
+	for _, m := range msg.moves {
+		t.move(m)
+	}
+	for _, r := range msg.rects {
+		t.dirty = t.dirty.add(r)
+	}
+}
+
+func (m move) apply(state *updaterState) {
+	if m = m.clip(state.img.Bounds()); !m.src.Empty() {
+		state.moves = append(state.moves, m)
+	}
+}
+
+// CopyRect reports, that the pixels of src were copied to dst, e.g. with
+// draw.Draw(img, src.Add(dst.Sub(src.Min)), img, src.Min, draw.Src).
+// Clients supporting CopyRect repeat the copy on their side, instead of
+// receiving the pixels again. CopyRect has to be called while holding the
+// framebuffer from Getfb, and takes effect when it is handed back through
+// Relfb. Moves are sent in the order of the calls, before the dirty
+// rectangles of the same update.
+func (serv *RfbServer) CopyRect(src image.Rectangle, dst image.Point) {
+	select {
+	case <-serv.done:
+	case serv.ctl <- move{src, dst}:
+	}
+}
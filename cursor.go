@@ -0,0 +1,233 @@
+package gorfb
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+type (
+	// cursor is the shape of the pointer, with the hotspot relative to
+	// the upper left corner of img.
+	cursor struct {
+		img *image.RGBA
+		hot image.Point
+	}
+	setCursor struct {
+		img image.Image
+		hot image.Point
+	}
+	cursorPos image.Point
+	// cursorMsg tells the dirtyTrackers about a new cursor shape or
+	// position. old and rect are the areas of the framebuffer covered
+	// by the cursor before and after the change.
+	cursorMsg struct {
+		old, rect image.Rectangle
+		shape     bool
+	}
+	// cursorImage is the framebuffer with the cursor drawn on top, for
+	// clients, which can not draw the cursor themselves.
+	cursorImage struct {
+		image.Image
+		cursor *image.RGBA
+		at     image.Point
+	}
+)
+
+const (
+	encodingCursor  = -239
+	encodingXCursor = -240
+)
+
+// Larger cursors are rejected, since the server keeps a copy of the cursor
+// image and sends all of it to the clients with every change.
+const maxCursorSize = 256
+
+// cursorEncoding returns the pseudo-encoding used to send the cursor shape
+// to the client, or 0 if the server has to draw the cursor.
+func (c clientEncodings) cursorEncoding() int32 {
+	if c.pseudo.check(encodingCursor) {
+		return encodingCursor
+	}
+	if c.pseudo.check(encodingXCursor) {
+		return encodingXCursor
+	}
+	return 0
+}
+
+// rect returns the area of the framebuffer covered by the cursor, when the
+// pointer is at pos.
+func (c *cursor) rect(pos image.Point) image.Rectangle {
+	if c == nil {
+		return image.Rectangle{}
+	}
+	return c.img.Bounds().Add(pos.Sub(c.hot))
+}
+
+func (state *updaterState) cursorRect() image.Rectangle {
+	return state.cursor.rect(state.cursorPos)
+}
+
+// cursorArea returns the visible part of cursorRect.
+func (state *updaterState) cursorArea() image.Rectangle {
+	return state.cursorRect().Intersect(state.img.Bounds())
+}
+
+func (m setCursor) apply(state *updaterState) {
+	old := state.cursorArea()
+	state.cursor = nil
+	state.cursorSet = true
+	if m.img != nil && !m.img.Bounds().Empty() {
+		b := m.img.Bounds()
+		img := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(img, img.Bounds(), m.img, b.Min, draw.Src)
+		state.cursor = &cursor{img, m.hot}
+	}
+	state.msgs = append(state.msgs, cursorMsg{old, state.cursorArea(), true})
+}
+
+func (p cursorPos) apply(state *updaterState) {
+	old := state.cursorArea()
+	state.cursorPos = image.Point(p)
+	if state.cursor != nil && old != state.cursorArea() {
+		state.msgs = append(state.msgs, cursorMsg{old, state.cursorArea(), false})
+	}
+}
+
+func (m cursorMsg) track(t *tracker) {
+	t.cursor = m.rect
+	t.cursorSet = t.cursorSet || m.shape
+	if t.choice.cursorEncoding() != 0 {
+		t.newCursor = t.newCursor || m.shape
+		return
+	}
+	t.dirty = t.dirty.add(m.old).add(m.rect)
+}
+
+// SetCursor sets the shape of the pointer shown by clients. Clients, which
+// support the Cursor or XCursor pseudo-encodings, draw it themselves, for
+// all other clients it is drawn into the framebuffer updates at the last
+// pointer position. hotspot is relative to the upper left corner of img.
+// A nil img hides the cursor. Until SetCursor is called, clients show
+// their own pointer. Images larger than 256 pixels in either direction,
+// like image.Uniform, and hotspots outside of img are rejected.
+func (serv *RfbServer) SetCursor(img image.Image, hotspot image.Point) error {
+	if img != nil {
+		size := img.Bounds().Size()
+		if size.X > maxCursorSize || size.Y > maxCursorSize {
+			return fmt.Errorf("Cursor of size %v is too large", size)
+		}
+		if !img.Bounds().Empty() && !hotspot.In(image.Rectangle{Max: size}) {
+			return fmt.Errorf("Cursor hotspot %v outside of %v", hotspot, size)
+		}
+	}
+	select {
+	case <-serv.done:
+	case serv.ctl <- setCursor{img, hotspot}:
+	}
+	return nil
+}
+
+func (c cursorImage) At(x, y int) color.Color {
+	p := image.Pt(x, y).Sub(c.at)
+	if !p.In(c.cursor.Bounds()) {
+		return c.Image.At(x, y)
+	}
+	src := c.cursor.RGBAAt(p.X, p.Y)
+	switch src.A {
+	case 0:
+		return c.Image.At(x, y)
+	case 0xff:
+		return src
+	}
+	// the cursor pixels are premultiplied by alpha
+	sr, sg, sb, sa := src.RGBA()
+	r, g, b, a := c.Image.At(x, y).RGBA()
+	k := 0xffff - sa
+	return color.RGBA64{
+		uint16(sr + r*k/0xffff),
+		uint16(sg + g*k/0xffff),
+		uint16(sb + b*k/0xffff),
+		uint16(sa + a*k/0xffff),
+	}
+}
+
+// softCursor returns img with the cursor drawn on top, if it overlaps rect.
+func (state *updaterState) softCursor(img image.Image, rect image.Rectangle) image.Image {
+	if !state.cursorRect().Overlaps(rect) {
+		return img
+	}
+	return cursorImage{img, state.cursor.img, state.cursorRect().Min}
+}
+
+// cursorMask returns a bitmap of the cursor pixels, for which set is true.
+// Every row is padded to whole bytes.
+func cursorMask(img *image.RGBA, set func(c color.RGBA) bool) []byte {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	stride := (w + 7) / 8
+	b := make([]byte, stride*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if set(img.RGBAAt(x, y)) {
+				b[y*stride+x/8] |= 0x80 >> uint(x%8)
+			}
+		}
+	}
+	return b
+}
+
+func opaque(c color.RGBA) bool {
+	return c.A >= 0x80
+}
+
+func dark(c color.RGBA) bool {
+	return 299*int(c.R)+587*int(c.G)+114*int(c.B) < 1000*int(c.A)/2
+}
+
+// encode returns the Cursor or XCursor pseudo-rectangle for the cursor c,
+// which is empty for a hidden cursor.
+func (c *cursor) encode(e int32, format PixelFormat) [][]byte {
+	if c == nil {
+		return [][]byte{rectHeader(image.Rectangle{}, e), {}}
+	}
+	var buf bytes.Buffer
+	if e == encodingCursor {
+		rawEncoder{}.Encode(&buf, c.img, c.img.Bounds(), format)
+		buf.Write(cursorMask(c.img, opaque))
+	} else {
+		// XCursor only has two colours: the average of the dark and
+		// of the light opaque pixels.
+		var sum [2][4]int
+		for y := 0; y < c.img.Bounds().Dy(); y++ {
+			for x := 0; x < c.img.Bounds().Dx(); x++ {
+				p := c.img.RGBAAt(x, y)
+				if !opaque(p) {
+					continue
+				}
+				i := 1
+				if dark(p) {
+					i = 0
+				}
+				sum[i][0] += int(p.R) * 0xff / int(p.A)
+				sum[i][1] += int(p.G) * 0xff / int(p.A)
+				sum[i][2] += int(p.B) * 0xff / int(p.A)
+				sum[i][3]++
+			}
+		}
+		for i, def := range []byte{0, 0xff} {
+			for j := 0; j < 3; j++ {
+				if sum[i][3] == 0 {
+					buf.WriteByte(def)
+				} else {
+					buf.WriteByte(byte(sum[i][j] / sum[i][3]))
+				}
+			}
+		}
+		buf.Write(cursorMask(c.img, dark))
+		buf.Write(cursorMask(c.img, opaque))
+	}
+	r := c.img.Bounds().Add(c.hot)
+	return [][]byte{rectHeader(r, e), buf.Bytes()}
+}
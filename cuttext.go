@@ -0,0 +1,84 @@
+package gorfb
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+type (
+	// CutTextPolicy decides how text sent to the clients' clipboard is
+	// treated, which can not be represented in Latin-1, the character
+	// set of the cut text messages.
+	CutTextPolicy    int
+	setCutTextPolicy CutTextPolicy
+)
+
+const (
+	// CutTextReplace replaces characters outside of Latin-1 with '?'.
+	CutTextReplace CutTextPolicy = iota
+	// CutTextStrip drops characters outside of Latin-1.
+	CutTextStrip
+	// CutTextReject does not send text containing characters outside
+	// of Latin-1 at all.
+	CutTextReject
+)
+
+// encodeLatin1 converts txt into Latin-1 with "\n" line endings, as
+// required for cut text messages. It returns false if policy rejects txt.
+func encodeLatin1(txt string, policy CutTextPolicy) ([]byte, bool) {
+	txt = strings.Replace(txt, "\r\n", "\n", -1)
+	b := make([]byte, 0, len(txt))
+	for _, r := range txt {
+		switch {
+		case r <= 0xff:
+			b = append(b, byte(r))
+		case policy == CutTextReplace:
+			b = append(b, '?')
+		case policy == CutTextReject:
+			return nil, false
+		}
+	}
+	return b, true
+}
+
+func decodeLatin1(b []byte) string {
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
+
+func (p setCutTextPolicy) apply(state *updaterState) {
+	state.cutTextPolicy = CutTextPolicy(p)
+}
+
+// serverCutText returns a ServerCutText message with the Latin-1 text txt.
+func serverCutText(txt []byte) []byte {
+	b := make([]byte, 8+len(txt))
+	b[0] = serverCutTextMsg
+	binary.BigEndian.PutUint32(b[4:8], uint32(len(txt)))
+	copy(b[8:], txt)
+	return b
+}
+
+// SetCutTextPolicy sets the treatment of text sent with SendCutText or
+// SetClipboard, which can not be represented in Latin-1, to clients without
+// the Extended Clipboard extension. The default is CutTextReplace.
+func (serv *RfbServer) SetCutTextPolicy(p CutTextPolicy) {
+	select {
+	case <-serv.done:
+	case serv.ctl <- setCutTextPolicy(p):
+	}
+}
+
+// SendCutText sets the clipboard of all clients to txt.
+func (serv *RfbServer) SendCutText(txt string) {
+	serv.SetClipboard(Clipboard{Text: txt})
+}
+
+// SendCutText sets the clipboard of the client to txt, e.g. to answer the
+// CutEvent of that client only.
+func (client *RfbClient) SendCutText(txt string) {
+	client.SetClipboard(Clipboard{Text: txt})
+}
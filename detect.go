@@ -0,0 +1,267 @@
+package gorfb
+
+import (
+	"bytes"
+	"hash/fnv"
+	"image"
+	"image/draw"
+)
+
+type (
+	// moveDetector finds moved regions by comparing the dirty rectangles
+	// of the framebuffer with a snapshot of the previous frame.
+	moveDetector struct {
+		prev *image.RGBA
+	}
+	detectMoves bool
+)
+
+// Scrolls shorter than this many lines are not worth a CopyRect.
+const minScrollLines = 8
+
+func (d detectMoves) apply(state *updaterState) {
+	if !d {
+		state.detector = nil
+	} else if state.detector == nil {
+		// The snapshot is taken when the framebuffer is handed
+		// back the next time.
+		state.detector = &moveDetector{}
+	}
+}
+
+// DetectMoves enables or disables the automatic detection of scrolled and
+// moved regions within the rectangles reported through Relfb. Detected
+// moves are sent to clients as CopyRect rectangles. The detection keeps a
+// copy of the framebuffer and compares it with every update.
+func (serv *RfbServer) DetectMoves(enable bool) {
+	select {
+	case <-serv.done:
+	case serv.ctl <- detectMoves(enable):
+	}
+}
+
+// detect returns the moves found within the dirty rectangles rs of img,
+// and the rectangles, which still have to be sent. The moves reported by
+// the application are applied to the snapshot first.
+func (d *moveDetector) detect(img image.Image, reported []move, rs []image.Rectangle) ([]move, []image.Rectangle) {
+	bounds := img.Bounds()
+	if d.prev == nil || d.prev.Bounds() != bounds {
+		d.prev = image.NewRGBA(bounds)
+		draw.Draw(d.prev, bounds, img, bounds.Min, draw.Src)
+		return nil, rs
+	}
+	for _, m := range reported {
+		draw.Draw(d.prev, m.dstRect(), d.prev, m.src.Min, draw.Src)
+	}
+
+	// rs belongs to the application.
+	rs = append([]image.Rectangle{}, rs...)
+	cur := make([]*image.RGBA, 0, len(rs))
+	for i, r := range rs {
+		rs[i] = r.Intersect(bounds)
+		c := image.NewRGBA(rs[i])
+		draw.Draw(c, rs[i], img, rs[i].Min, draw.Src)
+		cur = append(cur, c)
+	}
+
+	moves := []move{}
+	// overlaps reports whether src was overwritten by one of the moves
+	// found so far, since the client applies them in order.
+	overlaps := func(src image.Rectangle) bool {
+		for _, m := range moves {
+			if m.dstRect().Overlaps(src) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Block moves: a rectangle has the previous content of another
+	// rectangle of the same size, like a window dragged elsewhere.
+	moved := make([]bool, len(rs))
+	for i, dst := range rs {
+		for _, src := range rs {
+			if dst.Empty() || src == dst || src.Size() != dst.Size() || overlaps(src) {
+				continue
+			}
+			if sameLines(d.prev, src, cur[i], dst, false, 0, dst.Dy()) {
+				moves = append(moves, move{src, dst.Min})
+				moved[i] = true
+				break
+			}
+		}
+	}
+	blocks := len(moves)
+
+	rest := []image.Rectangle{}
+	for i, r := range rs {
+		if moved[i] || r.Empty() {
+			continue
+		}
+		parts := []image.Rectangle{r}
+		// Scrolling within a single rectangle.
+		m, ok := d.scroll(cur[i], r, false)
+		if !ok {
+			m, ok = d.scroll(cur[i], r, true)
+		}
+		if ok && !overlaps(m.src) {
+			moves = append(moves, m)
+			parts = subtract(r, m.dstRect())
+		}
+		// The parts covered by a moved block need not be sent again.
+		for _, m := range moves[:blocks] {
+			var left []image.Rectangle
+			for _, p := range parts {
+				left = append(left, subtract(p, m.dstRect())...)
+			}
+			parts = left
+		}
+		rest = append(rest, parts...)
+	}
+
+	for i, r := range rs {
+		draw.Draw(d.prev, r, cur[i], r.Min, draw.Src)
+	}
+	return moves, rest
+}
+
+// line returns the i-th row, or column if vertical is set, of img within
+// r as bytes.
+func line(img *image.RGBA, r image.Rectangle, vertical bool, i int) []byte {
+	if !vertical {
+		off := img.PixOffset(r.Min.X, r.Min.Y+i)
+		return img.Pix[off : off+4*r.Dx()]
+	}
+	b := make([]byte, 0, 4*r.Dy())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		off := img.PixOffset(r.Min.X+i, y)
+		b = append(b, img.Pix[off:off+4]...)
+	}
+	return b
+}
+
+// sameLines reports whether the lines from first to last of a within ra
+// equal those of b within rb.
+func sameLines(a *image.RGBA, ra image.Rectangle, b *image.RGBA, rb image.Rectangle, vertical bool, first, last int) bool {
+	for i := first; i < last; i++ {
+		if !bytes.Equal(line(a, ra, vertical, i), line(b, rb, vertical, i)) {
+			return false
+		}
+	}
+	return true
+}
+
+func hashLine(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+	return h.Sum64()
+}
+
+// uniform reports whether all pixels of the line b are the same.
+func uniform(b []byte) bool {
+	for i := 4; i < len(b); i += 4 {
+		if !bytes.Equal(b[i:i+4], b[:4]) {
+			return false
+		}
+	}
+	return true
+}
+
+// scroll looks for a vertical scroll of the rows of r, or a horizontal one
+// of its columns if vertical is set. Every line votes for the offsets to
+// the previous lines with the same hash, and the longest run of lines
+// matching the offset with the most votes becomes a move.
+func (d *moveDetector) scroll(cur *image.RGBA, r image.Rectangle, vertical bool) (move, bool) {
+	n := r.Dy()
+	if vertical {
+		n = r.Dx()
+	}
+	if n < 2*minScrollLines {
+		return move{}, false
+	}
+	prevh := make([]uint64, n)
+	curh := make([]uint64, n)
+	index := make(map[uint64][]int)
+	for i := 0; i < n; i++ {
+		pl := line(d.prev, r, vertical, i)
+		prevh[i] = hashLine(pl)
+		if !uniform(pl) && len(index[prevh[i]]) < 4 {
+			index[prevh[i]] = append(index[prevh[i]], i)
+		}
+		curh[i] = hashLine(line(cur, r, vertical, i))
+	}
+	votes := make(map[int]int)
+	best := 0
+	for i, h := range curh {
+		for _, j := range index[h] {
+			if off := i - j; off != 0 {
+				votes[off]++
+				if votes[off] > votes[best] {
+					best = off
+				}
+			}
+		}
+	}
+	if votes[best] < minScrollLines {
+		return move{}, false
+	}
+
+	// The longest run of lines i with the previous content of i-best.
+	start, length := 0, 0
+	for i := 0; i < n; {
+		if i-best < 0 || i-best >= n || curh[i] != prevh[i-best] {
+			i++
+			continue
+		}
+		j := i
+		for j < n && j-best >= 0 && j-best < n && curh[j] == prevh[j-best] {
+			j++
+		}
+		if j-i > length {
+			start, length = i, j-i
+		}
+		i = j
+	}
+	if length < minScrollLines {
+		return move{}, false
+	}
+	// The hashes may collide.
+	if !sameLines(d.prev, r.Add(shift(-best, vertical)), cur, r, vertical, start, start+length) {
+		return move{}, false
+	}
+	dst := r
+	if vertical {
+		dst.Min.X, dst.Max.X = r.Min.X+start, r.Min.X+start+length
+	} else {
+		dst.Min.Y, dst.Max.Y = r.Min.Y+start, r.Min.Y+start+length
+	}
+	return move{dst.Sub(shift(best, vertical)), dst.Min}, true
+}
+
+// shift returns an offset of n lines.
+func shift(n int, vertical bool) image.Point {
+	if vertical {
+		return image.Pt(n, 0)
+	}
+	return image.Pt(0, n)
+}
+
+// subtract returns the parts of r outside of s.
+func subtract(r, s image.Rectangle) []image.Rectangle {
+	s = s.Intersect(r)
+	if s.Empty() {
+		return []image.Rectangle{r}
+	}
+	res := []image.Rectangle{}
+	for _, p := range []image.Rectangle{
+		image.Rect(r.Min.X, r.Min.Y, r.Max.X, s.Min.Y),
+		image.Rect(r.Min.X, s.Max.Y, r.Max.X, r.Max.Y),
+		image.Rect(r.Min.X, s.Min.Y, s.Min.X, s.Max.Y),
+		image.Rect(s.Max.X, s.Min.Y, r.Max.X, s.Max.Y),
+	} {
+		if !p.Empty() {
+			res = append(res, p)
+		}
+	}
+	return res
+}
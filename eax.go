@@ -0,0 +1,114 @@
+package gorfb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+)
+
+// eax is the EAX mode of AES, as used by the RSA-AES security types. It
+// implements cipher.AEAD with 16 byte nonces and tags.
+type eax struct {
+	block  cipher.Block
+	k1, k2 [aes.BlockSize]byte
+}
+
+var errOpen = errors.New("message authentication failed")
+
+func newEAX(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	e := &eax{block: block}
+	// The CMAC subkeys
+	block.Encrypt(e.k1[:], e.k1[:])
+	double(&e.k1)
+	e.k2 = e.k1
+	double(&e.k2)
+	return e, nil
+}
+
+// double multiplies b by x in GF(2^128).
+func double(b *[aes.BlockSize]byte) {
+	carry := b[0] >> 7
+	for i := 0; i < len(b)-1; i++ {
+		b[i] = b[i]<<1 | b[i+1]>>7
+	}
+	b[len(b)-1] = b[len(b)-1]<<1 ^ 0x87*carry
+}
+
+// omac returns the CMAC of the block [t] followed by data.
+func (e *eax) omac(t byte, data []byte) []byte {
+	mac := make([]byte, aes.BlockSize)
+	mac[aes.BlockSize-1] = t
+	if len(data) == 0 {
+		xor(mac, mac, e.k1[:])
+		e.block.Encrypt(mac, mac)
+		return mac
+	}
+	e.block.Encrypt(mac, mac)
+	for len(data) > aes.BlockSize {
+		xor(mac, mac, data[:aes.BlockSize])
+		e.block.Encrypt(mac, mac)
+		data = data[aes.BlockSize:]
+	}
+	last := make([]byte, aes.BlockSize)
+	copy(last, data)
+	if len(data) == aes.BlockSize {
+		xor(last, last, e.k1[:])
+	} else {
+		last[len(data)] = 0x80
+		xor(last, last, e.k2[:])
+	}
+	xor(mac, mac, last)
+	e.block.Encrypt(mac, mac)
+	return mac
+}
+
+func (e *eax) NonceSize() int {
+	return aes.BlockSize
+}
+
+func (e *eax) Overhead() int {
+	return aes.BlockSize
+}
+
+// tag returns the authentication tag of the ciphertext c, given the OMAC n
+// of the nonce.
+func (e *eax) tag(n, ad, c []byte) []byte {
+	t := append([]byte{}, n...)
+	xor(t, t, e.omac(1, ad))
+	xor(t, t, e.omac(2, c))
+	return t
+}
+
+func (e *eax) Seal(dst, nonce, plaintext, ad []byte) []byte {
+	n := e.omac(0, nonce)
+	c := make([]byte, len(plaintext))
+	cipher.NewCTR(e.block, n).XORKeyStream(c, plaintext)
+	dst = append(dst, c...)
+	return append(dst, e.tag(n, ad, c)...)
+}
+
+func (e *eax) Open(dst, nonce, ciphertext, ad []byte) ([]byte, error) {
+	if len(ciphertext) < aes.BlockSize {
+		return nil, errOpen
+	}
+	n := e.omac(0, nonce)
+	c := ciphertext[:len(ciphertext)-aes.BlockSize]
+	if subtle.ConstantTimeCompare(e.tag(n, ad, c), ciphertext[len(c):]) != 1 {
+		return nil, errOpen
+	}
+	p := make([]byte, len(c))
+	cipher.NewCTR(e.block, n).XORKeyStream(p, c)
+	return append(dst, p...), nil
+}
+
+// xor sets dst to a xor b.
+func xor(dst, a, b []byte) {
+	for i := range dst {
+		dst[i] = a[i] ^ b[i]
+	}
+}
@@ -0,0 +1,51 @@
+package gorfb
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// Test vectors from the EAX paper by Bellare, Rogaway and Wagner.
+var eaxTests = []struct {
+	msg, key, nonce, header, out string
+}{
+	{"", "233952DEE4D5ED5F9B9C6D6FF80FF478", "62EC67F9C3A4A407FCB2A8C49031A8B3", "6BFB914FD07EAE6B", "E037830E8389F27B025A2D6527E79D01"},
+	{"F7FB", "91945D3F4DCBEE0BF45EF52255F095A4", "BECAF043B0A23D843194BA972C66DEBD", "FA3BFD4806EB53FA", "19DD5C4C9331049D0BDAB0277408F67967E5"},
+	{"1A47CB4933", "01F74AD64077F2E704C0F60ADA3DD523", "70C3DB4F0D26368400A10ED05D2BFF5E", "234A3463C1264AC6", "D851D5BAE03A59F238A23E39199DC9266626C40F80"},
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestEAX(t *testing.T) {
+	for i, tt := range eaxTests {
+		msg := decodeHex(t, tt.msg)
+		nonce := decodeHex(t, tt.nonce)
+		header := decodeHex(t, tt.header)
+		out := decodeHex(t, tt.out)
+		e, err := newEAX(decodeHex(t, tt.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c := e.Seal(nil, nonce, msg, header); !bytes.Equal(c, out) {
+			t.Errorf("%v: Seal returned %X, want %X", i, c, out)
+		}
+		p, err := e.Open(nil, nonce, out, header)
+		if err != nil || !bytes.Equal(p, msg) {
+			t.Errorf("%v: Open returned %X, %v, want %X", i, p, err, msg)
+		}
+		for j := range out {
+			tampered := append([]byte{}, out...)
+			tampered[j] ^= 1
+			if _, err := e.Open(nil, nonce, tampered, header); err != errOpen {
+				t.Errorf("%v: Open accepted a message changed at byte %v", i, j)
+			}
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package gorfb
+
+import (
+	"errors"
+	"image"
+	"io"
+)
+
+type (
+	// Encoder implements a rectangle encoding. The Encoders registered
+	// with the server serve as prototypes: every client connection gets
+	// its own instance from New, so an Encoder may keep state, like a
+	// compression stream, across updates of the same client.
+	Encoder interface {
+		// Encoding returns the encoding number used in SetEncodings
+		// and in the rectangle headers.
+		Encoding() int32
+		// New returns an Encoder for a single client connection.
+		// Stateless Encoders may return themselves.
+		New() Encoder
+		// Encode writes the data of rect, which follows the rectangle
+		// header, with pixels in the client's pixel format. rect is
+		// sent raw instead, if Encode fails.
+		Encode(w io.Writer, img image.Image, rect image.Rectangle, format PixelFormat) error
+	}
+	// clientEncodings records the last SetEncodings message of a client.
+	// Encodings are kept in the client's order of preference, while
+	// pseudo-encodings only announce support for protocol extensions.
+	clientEncodings struct {
+		prefs  encodings
+		pseudo encodings
+	}
+	// splitter is implemented by Encoders, which limit the size of the
+	// rectangles they can encode.
+	splitter interface {
+		split(rect image.Rectangle) []image.Rectangle
+	}
+	// configurer is implemented by Encoders, which depend on the
+	// pseudo-encodings announced by the client.
+	configurer interface {
+		configure(c clientEncodings)
+	}
+	registerEncoder struct {
+		e Encoder
+	}
+)
+
+// Rectangles with at most this many pixels are always sent raw, since
+// the overhead of any other encoding exceeds the pixel data.
+const rawThreshold = 16
+
+// errLargerThanRaw makes an Encoder fall back to raw encoding, without
+// logging a failure.
+var errLargerThanRaw = errors.New("encoding is larger than raw")
+
+// The clients, which never sent SetEncodings, only get raw encoding.
+var defaultEncodings = clientEncodings{prefs: encodings{encodingRaw}}
+
+func isPseudoEncoding(e int32) bool {
+	return e < 0
+}
+
+func newClientEncodings(e encodings) clientEncodings {
+	var c clientEncodings
+	for _, val := range e {
+		if isPseudoEncoding(val) {
+			c.pseudo = append(c.pseudo, val)
+		} else if !c.prefs.check(val) {
+			c.prefs = append(c.prefs, val)
+		}
+	}
+	return c
+}
+
+// level returns the level of the first pseudo-encoding in the range from
+// first to last, or -1 if the client did not announce any.
+func (c clientEncodings) level(first, last int32) int {
+	for _, e := range c.pseudo {
+		if e >= first && e <= last {
+			return int(e - first)
+		}
+	}
+	return -1
+}
+
+// has reports whether the client announced the (pseudo-)encoding e.
+func (c clientEncodings) has(e int32) bool {
+	return c.prefs.check(e) || c.pseudo.check(e)
+}
+
+func builtinEncoders() map[int32]Encoder {
+	return map[int32]Encoder{
+		encodingRaw:     rawEncoder{},
+		encodingRRE:     rreEncoder{},
+		encodingCoRRE:   correEncoder{},
+		encodingHextile: hextileEncoder{},
+		encodingZlib:    &zlibEncoder{},
+		encodingTight:   &tightEncoder{},
+		encodingTRLE:    trleEncoder{},
+		encodingZRLE:    &zrleEncoder{},
+	}
+}
+
+// choose returns the encoding to use for rect: the client's most preferred
+// encoding, which the server implements. Raw encoding is always available.
+func (state *updaterState) choose(c clientEncodings, rect image.Rectangle) int32 {
+	if rect.Dx()*rect.Dy() <= rawThreshold {
+		return encodingRaw
+	}
+	for _, e := range c.prefs {
+		if _, ok := state.encoders[e]; ok {
+			return e
+		}
+	}
+	return encodingRaw
+}
+
+// encoder returns the connection's instance of the encoding e.
+func (conn *connState) encoder(state *updaterState, e int32) Encoder {
+	enc, ok := conn.encoders[e]
+	if !ok {
+		enc = state.encoders[e].New()
+		conn.encoders[e] = enc
+	}
+	return enc
+}
+
+func (msg registerEncoder) apply(state *updaterState) {
+	state.encoders[msg.e.Encoding()] = msg.e
+}
+
+// RegisterEncoder adds the encoding implemented by e to the encodings
+// offered to clients, or replaces the built-in implementation of it.
+// Clients, which already used the encoding, keep their instance of the
+// previous Encoder.
+func (serv *RfbServer) RegisterEncoder(e Encoder) {
+	select {
+	case <-serv.done:
+	case serv.ctl <- registerEncoder{e}:
+	}
+}
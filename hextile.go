@@ -0,0 +1,107 @@
+package gorfb
+
+import (
+	"bytes"
+	"image"
+	"io"
+)
+
+type hextileEncoder struct{}
+
+const (
+	hextileRaw              = 1
+	hextileBackground       = 2
+	hextileForeground       = 4
+	hextileAnySubrects      = 8
+	hextileSubrectsColoured = 16
+)
+
+func (hextileEncoder) Encoding() int32 {
+	return encodingHextile
+}
+
+func (e hextileEncoder) New() Encoder {
+	return e
+}
+
+func (hextileEncoder) Encode(w io.Writer, img image.Image, rect image.Rectangle, format PixelFormat) error {
+	var buf bytes.Buffer
+	bypp := format.BytesPerPixel()
+	px := pixels(img, rect, format)
+	pix := make([]byte, bypp)
+	putPixel := func(p uint32) {
+		format.PutPixel(pix, p)
+		buf.Write(pix)
+	}
+
+	// The background and foreground colours are inherited by the
+	// following tiles, but become undefined after a raw tile.
+	var bg, fg uint32
+	bgValid, fgValid := false, false
+	for y := 0; y < rect.Dy(); y += 16 {
+		for x := 0; x < rect.Dx(); x += 16 {
+			tw, th := tileSize(rect, x, y, 16)
+			t := tile(px, rect.Dx(), x, y, tw, th)
+			order, _ := colorCounts(t, 2)
+			tbg := background(t)
+
+			var flags byte
+			var data bytes.Buffer
+			if !bgValid || tbg != bg {
+				flags |= hextileBackground
+			}
+			if len(order) > 1 {
+				rs := subrects(t, tw, th, tbg)
+				flags |= hextileAnySubrects
+				coloured := len(order) > 2
+				if coloured {
+					flags |= hextileSubrectsColoured
+				} else if !fgValid || rs[0].p != fg {
+					flags |= hextileForeground
+				}
+				data.WriteByte(byte(len(rs)))
+				for _, r := range rs {
+					if coloured {
+						format.PutPixel(pix, r.p)
+						data.Write(pix)
+					}
+					data.WriteByte(byte(r.x<<4 | r.y))
+					data.WriteByte(byte((r.w-1)<<4 | (r.h - 1)))
+				}
+				if coloured {
+					fgValid = false
+				} else {
+					fg = rs[0].p
+				}
+			}
+
+			size := data.Len()
+			if flags&hextileBackground != 0 {
+				size += bypp
+			}
+			if flags&hextileForeground != 0 {
+				size += bypp
+			}
+			if size >= tw*th*bypp {
+				buf.WriteByte(hextileRaw)
+				for _, p := range t {
+					putPixel(p)
+				}
+				bgValid, fgValid = false, false
+				continue
+			}
+			buf.WriteByte(flags)
+			if flags&hextileBackground != 0 {
+				putPixel(tbg)
+			}
+			if flags&hextileForeground != 0 {
+				putPixel(fg)
+				fgValid = true
+			}
+			buf.Write(data.Bytes())
+			bg, bgValid = tbg, true
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
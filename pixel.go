@@ -0,0 +1,122 @@
+package gorfb
+
+import (
+	"encoding/binary"
+	"image/color"
+)
+
+// valid reports whether the pixel format can be produced by the encoders.
+func (f PixelFormat) valid() bool {
+	if f.bpp != 8 && f.bpp != 16 && f.bpp != 32 {
+		return false
+	}
+	if f.depth == 0 || f.depth > f.bpp {
+		return false
+	}
+	if f.trueColor == 0 {
+		return true
+	}
+	return maxBits(f.redMax)+int(f.redShift) <= int(f.bpp) &&
+		maxBits(f.greenMax)+int(f.greenShift) <= int(f.bpp) &&
+		maxBits(f.blueMax)+int(f.blueShift) <= int(f.bpp)
+}
+
+func maxBits(max uint16) int {
+	n := 0
+	for ; max != 0; max >>= 1 {
+		n++
+	}
+	return n
+}
+
+// BytesPerPixel returns the number of bytes used by a single pixel on the
+// wire.
+func (f PixelFormat) BytesPerPixel() int {
+	return int(f.bpp) / 8
+}
+
+// scale maps a 16-bit colour intensity onto the range [0, max].
+func scale(v uint32, max uint16) uint32 {
+	return uint32((uint64(v)*uint64(max) + 0x7fff) / 0xffff)
+}
+
+// TrueColor reports whether pixel values encode colour intensities, rather
+// than indices into the colour map.
+func (f PixelFormat) TrueColor() bool {
+	return f.trueColor != 0
+}
+
+// Pixel converts c into a pixel value of format f. For colour map formats
+// this is the index of the closest colour in the colour map.
+func (f PixelFormat) Pixel(c color.Color) uint32 {
+	if f.trueColor == 0 {
+		return f.cmap.index(c)
+	}
+	r, g, b, _ := c.RGBA()
+	return scale(r, f.redMax)<<f.redShift |
+		scale(g, f.greenMax)<<f.greenShift |
+		scale(b, f.blueMax)<<f.blueShift
+}
+
+// PutPixel stores the pixel value p at the beginning of b, using the byte
+// order requested by the client.
+func (f PixelFormat) PutPixel(b []byte, p uint32) {
+	switch f.bpp {
+	case 8:
+		b[0] = byte(p)
+	case 16:
+		if f.beflag != 0 {
+			binary.BigEndian.PutUint16(b, uint16(p))
+		} else {
+			binary.LittleEndian.PutUint16(b, uint16(p))
+		}
+	case 32:
+		if f.beflag != 0 {
+			binary.BigEndian.PutUint32(b, p)
+		} else {
+			binary.LittleEndian.PutUint32(b, p)
+		}
+	}
+}
+
+// cpixelSize returns the size of a compressed pixel, as used by ZRLE, TRLE
+// and Tight: 32bpp true colour pixels, which leave either the most or the
+// least significant byte unused, are sent in 3 bytes.
+func (f PixelFormat) cpixelSize() int {
+	if f.fitsLow() || f.fitsHigh() {
+		return 3
+	}
+	return f.BytesPerPixel()
+}
+
+func (f PixelFormat) colorMask() uint32 {
+	return uint32(f.redMax)<<f.redShift |
+		uint32(f.greenMax)<<f.greenShift |
+		uint32(f.blueMax)<<f.blueShift
+}
+
+func (f PixelFormat) fitsLow() bool {
+	return f.trueColor != 0 && f.bpp == 32 && f.depth <= 24 &&
+		f.colorMask()&0xff000000 == 0
+}
+
+func (f PixelFormat) fitsHigh() bool {
+	return f.trueColor != 0 && f.bpp == 32 && f.depth <= 24 &&
+		f.colorMask()&0xff == 0
+}
+
+// putCPixel stores the compressed pixel value p at the beginning of b.
+func (f PixelFormat) putCPixel(b []byte, p uint32) {
+	if f.cpixelSize() != 3 {
+		f.PutPixel(b, p)
+		return
+	}
+	if !f.fitsLow() {
+		p >>= 8
+	}
+	if f.beflag != 0 {
+		b[0], b[1], b[2] = byte(p>>16), byte(p>>8), byte(p)
+	} else {
+		b[0], b[1], b[2] = byte(p), byte(p>>8), byte(p>>16)
+	}
+}
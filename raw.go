@@ -0,0 +1,35 @@
+package gorfb
+
+import (
+	"image"
+	"io"
+)
+
+type rawEncoder struct{}
+
+func (rawEncoder) Encoding() int32 {
+	return encodingRaw
+}
+
+func (e rawEncoder) New() Encoder {
+	return e
+}
+
+func (rawEncoder) Encode(w io.Writer, img image.Image, rect image.Rectangle, format PixelFormat) error {
+	x := rect.Min.X
+	y := rect.Min.Y
+	wd := rect.Dx()
+	h := rect.Dy()
+	bypp := format.BytesPerPixel()
+
+	// Rectangle data
+	rawbuf := make([]byte, wd*h*bypp)
+	for i := 0; i < h; i++ {
+		for j := 0; j < wd; j++ {
+			p := format.Pixel(img.At(x+j, y+i))
+			format.PutPixel(rawbuf[(i*wd+j)*bypp:], p)
+		}
+	}
+	_, err := w.Write(rawbuf)
+	return err
+}
@@ -0,0 +1,308 @@
+package gorfb
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+type (
+	// Screen describes a monitor showing part of the framebuffer.
+	Screen struct {
+		ID    uint32
+		Rect  image.Rectangle
+		Flags uint32
+	}
+	// ResizeHandler decides about the framebuffer size and the screen
+	// layout requested by a client. It accepts the request by returning
+	// ResizeOK and the framebuffer to use from now on, or nil to keep the
+	// current one, and rejects it by returning one of the other Resize
+	// status codes.
+	ResizeHandler func(size image.Point, screens []Screen) (draw.Image, int)
+
+	resize struct {
+		img     draw.Image
+		screens []Screen
+		origin  *connState
+	}
+	setResizeHandler ResizeHandler
+	// desktopSizeReq is a SetDesktopSize request of the client origin.
+	desktopSizeReq struct {
+		size    image.Point
+		screens []Screen
+		origin  *connState
+		ctl     chan<- updaterMsg
+		done    <-chan interface{}
+	}
+	// getBounds asks the updater for the current framebuffer bounds.
+	getBounds chan image.Rectangle
+	// newLayout tells the dirtyTrackers about the framebuffer bounds and
+	// the screen layout, which were requested by the client origin, if
+	// any. replaced is set, if the framebuffer itself was replaced.
+	newLayout struct {
+		bounds   image.Rectangle
+		screens  []Screen
+		origin   *connState
+		replaced bool
+	}
+	// layoutStatus tells the client origin, why its request failed.
+	layoutStatus struct {
+		origin *connState
+		status int
+	}
+	// letterbox shows the framebuffer to clients with a different
+	// framebuffer size: pixels outside of the framebuffer are black.
+	letterbox struct {
+		image.Image
+	}
+)
+
+const (
+	encodingDesktopSize         = -223
+	encodingExtendedDesktopSize = -308
+)
+
+// Status codes of a SetDesktopSize request
+const (
+	ResizeOK             = 0
+	ResizeProhibited     = 1
+	ResizeOutOfResources = 2
+	ResizeInvalidLayout  = 3
+)
+
+// Reasons for an ExtendedDesktopSize rectangle
+const (
+	resizeByServer      = 0
+	resizeByClient      = 1
+	resizeByOtherClient = 2
+)
+
+// layout returns the screens of the framebuffer: a single one, unless set
+// by the application.
+func (state *updaterState) layout() []Screen {
+	if len(state.screens) > 0 {
+		return state.screens
+	}
+	return []Screen{{Rect: state.img.Bounds()}}
+}
+
+func (m resize) apply(state *updaterState) {
+	if m.img != nil {
+		// Pending moves and the snapshot of the move detector refer
+		// to the previous framebuffer.
+		state.moves = nil
+		if state.detector != nil {
+			state.detector.prev = nil
+		}
+		state.img = m.img
+	}
+	state.screens = append([]Screen{}, m.screens...)
+	state.msgs = append(state.msgs, newLayout{state.img.Bounds(), state.layout(), m.origin, m.img != nil})
+}
+
+func (h setResizeHandler) apply(state *updaterState) {
+	state.resizeHandler = ResizeHandler(h)
+}
+
+func (r desktopSizeReq) apply(state *updaterState) {
+	h := state.resizeHandler
+	if h == nil {
+		state.msgs = append(state.msgs, layoutStatus{r.origin, ResizeProhibited})
+		return
+	}
+	// The application may take its time, or use the server meanwhile.
+	go func() {
+		img, status := h(r.size, r.screens)
+		var msg updaterMsg = resize{img, r.screens, r.origin}
+		if status != ResizeOK {
+			msg = layoutStatus{r.origin, status}
+		}
+		select {
+		case <-r.done:
+		case r.ctl <- msg:
+		}
+	}()
+}
+
+func (ch getBounds) apply(state *updaterState) {
+	ch <- state.img.Bounds()
+}
+
+func sameScreens(a, b []Screen) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (l newLayout) track(t *tracker) {
+	resized := l.bounds != t.bounds
+	if l.replaced && !resized {
+		// The contents of the framebuffer changed everywhere.
+		t.dirty = t.dirty.add(t.size)
+		t.moves = nil
+	}
+	if !resized && sameScreens(l.screens, t.screens) && l.origin != t.conn {
+		return
+	}
+	t.bounds = l.bounds
+	t.screens = l.screens
+	if resized {
+		t.moves = nil
+	}
+	switch {
+	case t.choice.has(encodingExtendedDesktopSize):
+		switch l.origin {
+		case nil:
+			t.reason = resizeByServer
+		case t.conn:
+			t.reason = resizeByClient
+		default:
+			t.reason = resizeByOtherClient
+		}
+		t.status = ResizeOK
+		t.resized = true
+		if resized {
+			t.resize()
+		}
+	case resized && t.choice.has(encodingDesktopSize):
+		t.resize()
+	case resized:
+		// The client keeps its framebuffer size, so all of it
+		// changes.
+		t.dirty = t.dirty.add(t.size)
+	}
+}
+
+func (s layoutStatus) apply(state *updaterState) {
+	state.msgs = append(state.msgs, s)
+}
+
+func (s layoutStatus) track(t *tracker) {
+	if s.origin == t.conn && t.choice.has(encodingExtendedDesktopSize) {
+		t.reason = resizeByClient
+		t.status = s.status
+		t.resized = true
+	}
+}
+
+// resize tells the client about the new framebuffer size with the next
+// update, and resends the whole framebuffer afterwards.
+func (t *tracker) resize() {
+	t.size = t.bounds
+	t.resized = true
+	t.dirty = mkclean().add(t.size)
+}
+
+// encodeLayout returns the DesktopSize or ExtendedDesktopSize rectangle of
+// the update u.
+func encodeLayout(u getUpdate) [][]byte {
+	if !u.choice.has(encodingExtendedDesktopSize) {
+		return [][]byte{rectHeader(u.size, encodingDesktopSize)}
+	}
+	r := image.Rect(u.reason, u.status, u.reason+u.size.Dx(), u.status+u.size.Dy())
+	b := make([]byte, 4+16*len(u.screens))
+	b[0] = byte(len(u.screens))
+	for i, s := range u.screens {
+		c := b[4+16*i:]
+		binary.BigEndian.PutUint32(c[0:4], s.ID)
+		binary.BigEndian.PutUint16(c[4:6], uint16(s.Rect.Min.X))
+		binary.BigEndian.PutUint16(c[6:8], uint16(s.Rect.Min.Y))
+		binary.BigEndian.PutUint16(c[8:10], uint16(s.Rect.Dx()))
+		binary.BigEndian.PutUint16(c[10:12], uint16(s.Rect.Dy()))
+		binary.BigEndian.PutUint32(c[12:16], s.Flags)
+	}
+	return [][]byte{rectHeader(r, encodingExtendedDesktopSize), b}
+}
+
+// decodeScreens decodes the screen array of a SetDesktopSize message.
+func decodeScreens(b []byte) []Screen {
+	res := make([]Screen, len(b)/16)
+	for i := range res {
+		c := b[16*i:]
+		x := int(binary.BigEndian.Uint16(c[4:6]))
+		y := int(binary.BigEndian.Uint16(c[6:8]))
+		w := int(binary.BigEndian.Uint16(c[8:10]))
+		h := int(binary.BigEndian.Uint16(c[10:12]))
+		res[i] = Screen{
+			ID:    binary.BigEndian.Uint32(c[0:4]),
+			Rect:  image.Rect(x, y, x+w, y+h),
+			Flags: binary.BigEndian.Uint32(c[12:16]),
+		}
+	}
+	return res
+}
+
+// validLayout reports whether the screens are within a framebuffer of the
+// given size and have distinct IDs.
+func validLayout(size image.Point, screens []Screen) bool {
+	if size.X == 0 || size.Y == 0 || len(screens) == 0 {
+		return false
+	}
+	bounds := image.Rectangle{Max: size}
+	ids := make(map[uint32]bool)
+	for _, s := range screens {
+		if s.Rect.Empty() || !s.Rect.In(bounds) || ids[s.ID] {
+			return false
+		}
+		ids[s.ID] = true
+	}
+	return true
+}
+
+func (l letterbox) At(x, y int) color.Color {
+	if !image.Pt(x, y).In(l.Image.Bounds()) {
+		return color.Black
+	}
+	return l.Image.At(x, y)
+}
+
+// screen returns the current framebuffer bounds.
+func (client *RfbClient) screen() (image.Rectangle, bool) {
+	ch := make(getBounds, 1)
+	select {
+	case <-client.done:
+		return image.Rectangle{}, false
+	case client.ctl <- ch:
+	}
+	return <-ch, true
+}
+
+// Resize replaces the framebuffer with img, which may have different
+// bounds, and is returned by Getfb from now on. screens describes the
+// monitors showing parts of img, which is a single screen otherwise.
+// Clients supporting the DesktopSize or ExtendedDesktopSize
+// pseudo-encodings are told about the new size, all other clients keep
+// their framebuffer size and see the upper left part of img, with black
+// borders if img is smaller. All clients receive the whole framebuffer
+// again.
+func (serv *RfbServer) Resize(img draw.Image, screens ...Screen) {
+	select {
+	case <-serv.done:
+	case serv.ctl <- resize{img: img, screens: screens}:
+	}
+}
+
+// SetScreens changes the screen layout of the current framebuffer.
+func (serv *RfbServer) SetScreens(screens ...Screen) {
+	select {
+	case <-serv.done:
+	case serv.ctl <- resize{screens: screens}:
+	}
+}
+
+// HandleResize sets the function deciding about the SetDesktopSize
+// requests of clients, which are rejected without one. h is called from
+// a goroutine of its own for every request.
+func (serv *RfbServer) HandleResize(h ResizeHandler) {
+	select {
+	case <-serv.done:
+	case serv.ctl <- setResizeHandler(h):
+	}
+}
@@ -1,14 +1,19 @@
 package gorfb
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"strconv"
 	"sync"
 )
 
@@ -19,24 +24,39 @@ type (
 		Txt     chan CutEvent
 		Getfb   chan draw.Image
 		Relfb   chan []image.Rectangle
-		regch   chan chan []image.Rectangle
-		unregch chan chan []image.Rectangle
+		regch   chan chan trackerMsg
+		unregch chan chan trackerMsg
+		ctl     chan updaterMsg
 		done    chan interface{}
 		wg      sync.WaitGroup
 		once    sync.Once
+		// clip reports clipboard contents, once the Extended
+		// Clipboard extension was enabled by closing clipOn.
+		clip     chan ClipboardEvent
+		clipOn   chan interface{}
+		clipOnce sync.Once
+		// pointer holds the latest pointer position for the updater.
+		pointer chan cursorPos
+		// auths are the security types offered to clients.
+		auths []Authenticator
 	}
 	RfbClient struct {
-		conn    net.Conn
-		bounds  image.Rectangle
-		mux     chan<- muxMsg
-		regch   <-chan chan []image.Rectangle
-		unregch chan<- chan []image.Rectangle
-		done    <-chan interface{}
+		conn     net.Conn
+		state    *connState
+		ctl      chan<- updaterMsg
+		mux      chan<- muxMsg
+		regch    <-chan chan trackerMsg
+		unregch  chan<- chan trackerMsg
+		done     <-chan interface{}
+		clipOn   <-chan interface{}
+		auths    []Authenticator
+		identity interface{}
 	}
 	PixelFormat struct {
 		bpp, depth, beflag, trueColor   uint8
 		redMax, greenMax, blueMax       uint16
 		redShift, greenShift, blueShift uint8
+		cmap                            *colorMap
 	}
 	encodings    []int32
 	serverStatus struct {
@@ -47,7 +67,8 @@ type (
 	updateRect struct {
 		image.Rectangle
 		incr   bool
-		choice encodings
+		choice clientEncodings
+		format PixelFormat
 	}
 	encodable interface {
 		encode() []byte
@@ -55,11 +76,97 @@ type (
 	getUpdate struct {
 		Dirty
 		outch  chan<- [][]byte
-		choice encodings
+		choice clientEncodings
+		format PixelFormat
+		moves  []move
+		cursor bool
+		// size is the client's framebuffer size, which is sent in a
+		// DesktopSize rectangle if resized is set.
+		size    image.Rectangle
+		screens []Screen
+		resized bool
+		reason  int
+		status  int
+		conn    *connState
+	}
+	// tracker is the state of a dirtyTracker goroutine.
+	tracker struct {
+		choice    clientEncodings
+		format    PixelFormat
+		wanted    image.Rectangle
+		dirty     Dirty
+		moves     []move
+		cursor    image.Rectangle
+		newCursor bool
+		// cursorSet tells whether the application ever set the
+		// cursor. Until then, clients keep their own cursor.
+		cursorSet bool
+		// bounds of the framebuffer, and size of the client's
+		// framebuffer, which differ for letterboxed clients.
+		bounds  image.Rectangle
+		size    image.Rectangle
+		screens []Screen
+		resized bool
+		reason  int
+		status  int
+		// out holds messages for the client besides the updates, which
+		// are sent between updates.
+		out [][]byte
+		// clip is the server clipboard, and the other fields the state
+		// of the Extended Clipboard extension.
+		clip        *Clipboard
+		clipPolicy  CutTextPolicy
+		clipOn      bool
+		capsSent    bool
+		clientCaps  uint32
+		clientSizes []uint32
+		conn        *connState
+	}
+	trackerMsg interface {
+		track(t *tracker)
+	}
+	// damage reports changes of the framebuffer to the dirtyTrackers.
+	damage struct {
+		rects []image.Rectangle
+		moves []move
+	}
+	// connState holds the state of a client connection, which is only
+	// accessed from the updater goroutine while encoding.
+	connState struct {
+		cmap     *colorMap
+		encoders map[int32]Encoder
+	}
+	updaterState struct {
+		img       draw.Image
+		reglist   []chan<- trackerMsg
+		moves     []move
+		palette   color.Palette
+		pal       color.Palette
+		colorMaps map[int]*colorMap
+		encoders  map[int32]Encoder
+		detector  *moveDetector
+		cursor    *cursor
+		cursorPos image.Point
+		cursorSet bool
+		screens   []Screen
+		// resizeHandler decides about SetDesktopSize requests.
+		resizeHandler ResizeHandler
+		cutTextPolicy CutTextPolicy
+		// clipboard is the server clipboard, for new clients.
+		clipboard clipboardMsg
+		clipOn    bool
+		// msgs are sent to the dirtyTrackers after a control message
+		// was applied.
+		msgs []trackerMsg
+	}
+	updaterMsg interface {
+		apply(state *updaterState)
 	}
 	rfbMuxState struct {
-		input chan<- InputEvent
-		cut   chan<- CutEvent
+		input   chan<- InputEvent
+		cut     chan<- CutEvent
+		clip    chan<- ClipboardEvent
+		pointer chan cursorPos
 	}
 	muxMsg interface {
 		work(state *rfbMuxState, done <-chan interface{})
@@ -70,9 +177,12 @@ type (
 		Key  uint32
 		Pos  image.Point
 		Mask uint8
+		// Client sent the event.
+		Client *RfbClient
 	}
 	CutEvent struct {
-		Txt string
+		Txt    string
+		Client *RfbClient
 	}
 )
 
@@ -80,6 +190,14 @@ const (
 	serverVersion = "RFB 003.008\n"
 )
 
+// The pixel format announced in ServerInit, which is used until the client
+// sends a SetPixelFormat message: 32bpp little-endian BGRX.
+var serverPixelFormat = PixelFormat{
+	bpp: 32, depth: 24, beflag: 0, trueColor: 1,
+	redMax: 255, greenMax: 255, blueMax: 255,
+	redShift: 16, greenShift: 8, blueShift: 0,
+}
+
 const (
 	setPixelFormatReq    = 0
 	setEncodingsReq      = 2
@@ -87,6 +205,7 @@ const (
 	keyEventReq          = 4
 	pointerEventReq      = 5
 	clientCutTextReq     = 6
+	setDesktopSizeReq    = 251
 )
 
 const (
@@ -99,9 +218,27 @@ const (
 const (
 	encodingRaw      = 0
 	encodingCopyrect = 1
+	encodingRRE      = 2
+	encodingCoRRE    = 4
+	encodingHextile  = 5
+	encodingZlib     = 6
+	encodingTight    = 7
+	encodingTRLE     = 15
+	encodingZRLE     = 16
 	// XXX
 )
 
+const (
+	encodingCompressLevel0 = -256
+	encodingCompressLevel9 = -247
+	encodingQualityLevel0  = -32
+	encodingQualityLevel9  = -23
+	encodingLastRect       = -224
+)
+
+// Clients sending more encodings than this are disconnected.
+const maxEncodings = 1024
+
 func reasonmsg(conn net.Conn, s string) {
 	b := make([]byte, 4)
 	binary.BigEndian.PutUint32(b, uint32(len(s)))
@@ -109,23 +246,32 @@ func reasonmsg(conn net.Conn, s string) {
 	fmt.Fprint(conn, s)
 }
 
-func getClientRfbVersion(conn net.Conn) (string, error) {
+// getClientRfbVersion returns the minor version of the protocol used with
+// the client: 7 or 8 if requested, and 3 for any other version, as some
+// clients report versions like 3.889, which use the handshake of 3.3.
+func getClientRfbVersion(conn net.Conn) (int, error) {
 	b := make([]byte, 12)
-	n, err := conn.Read(b)
-	if err != nil || n != 12 {
-		return "", err
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return 0, err
+	}
+	v := string(b)
+	minor, err := strconv.Atoi(v[8:11])
+	if v[:8] != "RFB 003." || v[11] != '\n' || err != nil {
+		return 0, fmt.Errorf("Invalid protocol version %q", v)
+	}
+	if minor == 7 || minor == 8 {
+		return minor, nil
 	}
-	return string(b), nil
+	return 3, nil
 }
 
-func makeServerSecurities() []byte {
-	return []byte{1, 1}
+func makeServerSecurities(types []uint8) []byte {
+	return append([]byte{byte(len(types))}, types...)
 }
 
 func getClientSecurity(conn net.Conn) (uint8, error) {
 	c := make([]byte, 1)
-	n, err := conn.Read(c)
-	if err != nil || n != 1 {
+	if _, err := io.ReadFull(conn, c); err != nil {
 		return 0, err
 	}
 	return uint8(c[0]), nil
@@ -137,8 +283,7 @@ func makeHandshake(x uint8) []byte {
 
 func getSharedFlag(conn net.Conn) (bool, error) {
 	d := make([]byte, 1)
-	n, err := conn.Read(d)
-	if err != nil || n != 1 {
+	if _, err := io.ReadFull(conn, d); err != nil {
 		return true, err
 	}
 	return d[0] == 1, nil
@@ -153,283 +298,440 @@ func (enc encodings) check(e int32) bool {
 	return false
 }
 
-func (enc encodings) filter(a encodings) (res encodings) {
-	for _, val := range enc {
-		if a.check(val) {
-			res = append(res, val)
-		}
+func (msg updateRect) track(t *tracker) {
+	t.request(msg)
+}
+
+func (t *tracker) request(msg updateRect) {
+	if msg.choice.cursorEncoding() != t.choice.cursorEncoding() {
+		// Either the client draws the cursor from now on, or the
+		// server has to.
+		t.newCursor = t.cursorSet
+		t.dirty = t.dirty.add(t.cursor)
+	}
+	ext := msg.choice.has(encodingExtendedDesktopSize)
+	if ext && !t.choice.has(encodingExtendedDesktopSize) {
+		// This tells the client, that it may request another
+		// framebuffer size.
+		t.reason = resizeByServer
+		t.status = ResizeOK
+		t.resized = true
+	}
+	t.choice = msg.choice
+	t.format = msg.format
+	if (ext || t.choice.has(encodingDesktopSize)) && t.size != t.bounds {
+		t.resize()
+	}
+	t.sendCaps()
+	t.wanted = msg.Rectangle
+	if !msg.incr {
+		t.dirty = t.dirty.add(msg.Rectangle)
 	}
-	return
 }
 
-func dirtyTracker(ch <-chan updateRect, fbch chan<- getUpdate, outch chan<- [][]byte, reg <-chan []image.Rectangle, done <-chan interface{}) {
-	var msg updateRect
+// pending reports whether the client's outstanding update request can be
+// answered.
+func (t *tracker) pending() bool {
+	if t.wanted.Empty() {
+		return false
+	}
+	return !t.dirty.intersect(t.wanted).empty() || len(t.moves) > 0 ||
+		(t.newCursor && t.choice.cursorEncoding() != 0) || t.resized
+}
 
-	choice := encodings{encodingRaw} // fallback
-	supported := encodings{encodingRaw}
-	wanted := image.Rect(0, 0, 0, 0)
-	dirty := mkclean()
+func (t *tracker) update(updata chan<- [][]byte) getUpdate {
+	if t.resized {
+		// The client requests the new framebuffer afterwards.
+		return getUpdate{outch: updata, choice: t.choice, format: t.format,
+			size: t.size, screens: t.screens, resized: true,
+			reason: t.reason, status: t.status, conn: t.conn}
+	}
+	return getUpdate{Dirty: t.dirty.intersect(t.wanted), outch: updata,
+		choice: t.choice, format: t.format, moves: t.moves,
+		cursor: t.newCursor, size: t.size, conn: t.conn}
+}
+
+// sent resets the wanted and dirty image.Rectangle
+func (t *tracker) sent() {
+	t.wanted = image.Rect(0, 0, 0, 0)
+	if t.resized {
+		t.resized = false
+		return
+	}
+	t.dirty = mkclean()
+	t.moves = nil
+	t.newCursor = false
+}
+
+// flush appends the queued messages to data, which must end between
+// framebuffer updates.
+func (t *tracker) flush(data [][]byte) [][]byte {
+	data = append(data, t.out...)
+	t.out = nil
+	return data
+}
+
+func dirtyTracker(ch <-chan trackerMsg, fbch chan<- getUpdate, outch chan<- [][]byte, reg <-chan trackerMsg, bounds image.Rectangle, conn *connState, done <-chan interface{}) {
+	t := tracker{
+		choice: defaultEncodings,
+		format: serverPixelFormat,
+		wanted: image.Rect(0, 0, 0, 0),
+		dirty:  mkclean(),
+		bounds: bounds,
+		size:   bounds,
+		conn:   conn,
+	}
 	nextdata := [][]byte{}
 	updata := make(chan [][]byte)
-	update_pending := false
+	updates_pending := 0
 	defer func() {
-		if update_pending {
-			<-updata
-			update_pending = false
+		for updates_pending > 0 {
+			if <-updata == nil {
+				updates_pending--
+			}
 		}
 		close(updata)
 	}()
 
 	for {
-		if dirty.intersect(wanted).empty() && len(nextdata) == 0 {
+		if updates_pending == 0 {
+			nextdata = t.flush(nextdata)
+		}
+		if !t.pending() && len(nextdata) == 0 {
 			select {
 			case <-done:
 				return
 			case d := <-updata:
-				update_pending = false
 				nextdata = append(nextdata, d...)
-			case msg := <-ch:
-				wanted = msg.Rectangle
-				if !msg.incr {
-					dirty = dirty.add(msg.Rectangle)
+				if d == nil {
+					// the update is complete
+					updates_pending--
+					nextdata = t.flush(nextdata)
 				}
-			case a := <-reg:
-				for _, b := range a {
-					dirty = dirty.add(b)
+			case msg := <-ch:
+				msg.track(&t)
+			case a, ok := <-reg:
+				if !ok {
+					return
 				}
+				a.track(&t)
 			}
-		} else if dirty.intersect(wanted).empty() {
+		} else if !t.pending() {
 			select {
 			case <-done:
 				return
 			case d := <-updata:
-				update_pending = false
 				nextdata = append(nextdata, d...)
+				if d == nil {
+					// the update is complete
+					updates_pending--
+					nextdata = t.flush(nextdata)
+				}
 			case outch <- nextdata:
 				nextdata = [][]byte{}
 			case msg := <-ch:
-				choice = msg.choice.filter(supported)
-				wanted = msg.Rectangle
-				if !msg.incr {
-					dirty = dirty.add(msg.Rectangle)
-				}
-			case a := <-reg:
-				for _, b := range a {
-					dirty = dirty.add(b)
+				msg.track(&t)
+			case a, ok := <-reg:
+				if !ok {
+					return
 				}
+				a.track(&t)
 			}
 		} else if len(nextdata) == 0 {
 			select {
 			case <-done:
 				return
 			case d := <-updata:
-				update_pending = false
 				nextdata = append(nextdata, d...)
-			case msg = <-ch:
-				wanted = msg.Rectangle
-				if !msg.incr {
-					dirty = dirty.add(msg.Rectangle)
+				if d == nil {
+					// the update is complete
+					updates_pending--
+					nextdata = t.flush(nextdata)
 				}
-			case a := <-reg:
-				for _, b := range a {
-					dirty = dirty.add(b)
+			case msg := <-ch:
+				msg.track(&t)
+			case a, ok := <-reg:
+				if !ok {
+					return
 				}
+				a.track(&t)
 			// This happens only when we can immediately read
 			// the image data as well.
-			case fbch <- getUpdate{dirty.intersect(wanted), updata, choice}:
-				// reset the wanted and dirty image.Rectangle
-				wanted = image.Rect(0, 0, 0, 0)
-				dirty = mkclean()
+			case fbch <- t.update(updata):
+				updates_pending++
+				t.sent()
 			}
 		} else {
 			select {
 			case <-done:
 				return
 			case outch <- nextdata:
-				update_pending = false
 				nextdata = [][]byte{}
 			case d := <-updata:
 				nextdata = append(nextdata, d...)
-			case msg = <-ch:
-				wanted = msg.Rectangle
-				if !msg.incr {
-					dirty = dirty.add(msg.Rectangle)
+				if d == nil {
+					// the update is complete
+					updates_pending--
+					nextdata = t.flush(nextdata)
 				}
-			case a := <-reg:
-				for _, b := range a {
-					dirty = dirty.add(b)
+			case msg := <-ch:
+				msg.track(&t)
+			case a, ok := <-reg:
+				if !ok {
+					return
 				}
+				a.track(&t)
 			// This happens only when we can immediately read
 			// the image data as well.
-			case fbch <- getUpdate{dirty.intersect(wanted), updata, choice}:
-				update_pending = true
-				// reset the wanted and dirty image.Rectangle
-				wanted = image.Rect(0, 0, 0, 0)
-				dirty = mkclean()
+			case fbch <- t.update(updata):
+				updates_pending++
+				t.sent()
 			}
 		}
 	}
 }
 
-func clientInput(in io.Reader, mux chan<- muxMsg, dt chan<- updateRect, done <-chan interface{}) {
-	choice := encodings{encodingRaw} // fallback
-	b := make([]byte, 1)
+// clientInput reads the messages of the client until the connection fails
+// or the client sends an invalid message, which is returned as the error.
+func clientInput(in io.Reader, client *RfbClient, conn *connState, dt chan<- trackerMsg, done <-chan interface{}) error {
+	r := bufio.NewReader(in)
+	mux := client.mux
+	choice := defaultEncodings
+	format := serverPixelFormat
 	for {
-		n, err := in.Read(b)
-		if err != nil || n != 1 {
-			log.Print(err)
-			return
+		typ, err := r.ReadByte()
+		if err != nil {
+			return err
 		}
-		switch b[0] {
+		switch typ {
 		case setPixelFormatReq:
 			var b [19]byte
 			var c [16]byte
-			n, err := in.Read(b[:])
-			if err != nil || n != 19 {
-				log.Print(err)
-				return
+			if _, err := io.ReadFull(r, b[:]); err != nil {
+				return err
 			}
 			copy(c[:], b[3:])
-			format := decodePixelFormat(c)
-			fmt.Printf("Pixel Format: %v\n", format)
+			f := decodePixelFormat(c)
+			if !f.valid() {
+				return fmt.Errorf("unsupported pixel format: %v", f)
+			}
+			format = f
 		case setEncodingsReq:
 			var b [3]byte
-			n, err := in.Read(b[:])
-			if err != nil || n != 3 {
-				log.Print(err)
-				return
+			if _, err := io.ReadFull(r, b[:]); err != nil {
+				return err
 			}
 			m := binary.BigEndian.Uint16(b[1:3])
-			c := make([]byte, 4*m)
-			for i := 0; i < int(m); i++ {
-				n, err := in.Read(c[4*i : 4*(i+1)])
-				if err != nil || n != 4 {
-					log.Print(err)
-					return
-				}
+			if m > maxEncodings {
+				return fmt.Errorf("too many encodings: %v", m)
+			}
+			c := make([]byte, 4*int(m))
+			if _, err := io.ReadFull(r, c); err != nil {
+				return err
 			}
-			choice := decodeEncodings(c)
-			fmt.Printf("Encodings: %v\n", choice)
+			e := decodeEncodings(c)
+			choice = newClientEncodings(e)
 		case framebufferUpdateReq:
 			var b [9]byte
-			n, err := in.Read(b[:])
-			if err != nil || n != 9 {
-				log.Print(err)
-				return
+			if _, err := io.ReadFull(r, b[:]); err != nil {
+				return err
 			}
 			select {
 			case <-done:
-				return
-			case dt <- updateRequest(b, choice):
+				return nil
+			case dt <- updateRequest(b, choice, format):
 			}
 		case keyEventReq:
 			var b [7]byte
-			n, err := in.Read(b[:])
-			if err != nil || n != 7 {
-				log.Print(err)
-				return
+			if _, err := io.ReadFull(r, b[:]); err != nil {
+				return err
 			}
 			select {
 			case <-done:
-				return
-			case mux <- kbdEvent(b):
+				return nil
+			case mux <- kbdEvent(b, client):
 			}
 		case pointerEventReq:
 			var b [5]byte
-			n, err := in.Read(b[:])
-			if err != nil || n != 5 {
-				log.Print(err)
-				return
+			if _, err := io.ReadFull(r, b[:]); err != nil {
+				return err
 			}
 			select {
 			case <-done:
-				return
-			case mux <- ptrEvent(b):
+				return nil
+			case mux <- ptrEvent(b, client):
 			}
 		case clientCutTextReq:
-			b := make([]byte, 7)
-			n, err := in.Read(b)
-			if err != nil || n != 7 {
-				log.Print(err)
-				return
+			var b [7]byte
+			if _, err := io.ReadFull(r, b[:]); err != nil {
+				return err
+			}
+			// A negative length marks an Extended Clipboard message.
+			length := int64(int32(binary.BigEndian.Uint32(b[3:7])))
+			extended := length < 0
+			if extended {
+				length = -length
+			}
+			if extended && length < 4 {
+				return fmt.Errorf("invalid Extended Clipboard message of %v bytes", length)
+			}
+			if length > maxClipboardSize {
+				log.Printf("dropping cut text of %v bytes", length)
+				if _, err := io.CopyN(ioutil.Discard, r, length); err != nil {
+					return err
+				}
+				continue
 			}
-			length := binary.BigEndian.Uint32(b[3:7])
 			c := make([]byte, length)
-			n, err = in.Read(c)
-			if err != nil || n != int(length) {
-				log.Print(err)
-				return
+			if _, err := io.ReadFull(r, c); err != nil {
+				return err
+			}
+			if !extended {
+				select {
+				case <-done:
+					return nil
+				case mux <- cutEvent(c, client):
+				}
+				continue
+			}
+			select {
+			case <-client.clipOn:
+			default:
+				// The extension was not offered.
+				continue
+			}
+			m := decodeClientClipboard(c)
+			if m.flags&(clipCaps|clipProvide) == clipProvide {
+				cb, err := decodeProvide(m.flags, c[4:])
+				if err != nil {
+					log.Print(err)
+					continue
+				}
+				select {
+				case <-done:
+					return nil
+				case mux <- ClipboardEvent{cb, client}:
+				}
+				continue
 			}
 			select {
 			case <-done:
-				return
-			case mux <- cutEvent(c):
+				return nil
+			case dt <- m:
+			}
+		case setDesktopSizeReq:
+			var b [7]byte
+			if _, err := io.ReadFull(r, b[:]); err != nil {
+				return err
 			}
+			w := int(binary.BigEndian.Uint16(b[1:3]))
+			h := int(binary.BigEndian.Uint16(b[3:5]))
+			c := make([]byte, 16*int(b[5]))
+			if _, err := io.ReadFull(r, c); err != nil {
+				return err
+			}
+			size, screens := image.Pt(w, h), decodeScreens(c)
+			var msg updaterMsg = desktopSizeReq{size, screens, conn, client.ctl, client.done}
+			if !validLayout(size, screens) {
+				msg = layoutStatus{conn, ResizeInvalidLayout}
+			}
+			select {
+			case <-done:
+				return nil
+			case client.ctl <- msg:
+			}
+		default:
+			// The length of unknown messages is unknown as well.
+			return fmt.Errorf("unknown message type %v", typ)
 		}
 	}
 }
 
-func clientOutput(out io.Writer, ch <-chan [][]byte, done <-chan interface{}) {
+func clientOutput(out io.Writer, ch <-chan [][]byte, done <-chan interface{}) error {
 	for {
 		select {
 		case <-done:
-			return
+			return nil
 		case b := <-ch:
 			for _, c := range b {
-				n, err := out.Write(c)
-				if err != nil || n < len(c) {
-					log.Print(err)
-					return
+				if _, err := out.Write(c); err != nil {
+					return err
 				}
 			}
 		}
 	}
 }
 
-func initializeConnection(conn net.Conn, bounds image.Rectangle) {
+// initializeConnection does the handshake with the client.
+func initializeConnection(client *RfbClient, bounds image.Rectangle) error {
+	conn := client.conn
 	fmt.Fprint(conn, serverVersion)
-	clientVersion, err := getClientRfbVersion(conn)
+	minor, err := getClientRfbVersion(conn)
 	if err != nil {
-		return
-	}
-	if clientVersion != serverVersion {
-		conn.Write([]byte{0})
-		reasonmsg(conn, "Unsupported")
-		return
+		return err
 	}
 
-	conn.Write(makeServerSecurities())
-	cs, err := getClientSecurity(conn)
-	if err != nil {
-		return
+	var cs uint8
+	if minor == 3 {
+		// The server chooses the security type, which can only be
+		// None or VNC Authentication.
+		for _, t := range securityTypes(client.auths) {
+			if t == securityNone || t == securityVNCAuth {
+				cs = t
+				break
+			}
+		}
+		conn.Write(makeHandshake(cs))
+		if cs == 0 {
+			err := errors.New("No security type supported by protocol version 3.3")
+			reasonmsg(conn, err.Error())
+			return err
+		}
+	} else {
+		conn.Write(makeServerSecurities(securityTypes(client.auths)))
+		cs, err = getClientSecurity(conn)
+		if err != nil {
+			return err
+		}
 	}
-	fmt.Printf("chosen security: %v\n", cs)
+	log.Printf("protocol version: 3.%v, chosen security: %v", minor, cs)
 
-	if cs != 1 {
-		conn.Write(makeHandshake(1))
-		reasonmsg(conn, fmt.Sprintf("Unsupported security type %v", cs))
-		return
+	if err := client.authenticate(cs, minor); err != nil {
+		return err
+	}
+	conn = client.conn
+	// Before 3.8, None is not followed by a SecurityResult.
+	if cs != securityNone || minor == 8 {
+		conn.Write(makeHandshake(0))
 	}
-	conn.Write(makeHandshake(0))
 
 	// Initialization
 	shared, err := getSharedFlag(conn)
 	if err != nil {
-		return
+		return err
 	}
 	fmt.Printf("shared: %v\n", shared)
-	format := PixelFormat{32, 24, 0, 1, 255, 255, 255, 16, 8, 0}
-	serverInit := serverStatus{bounds.Dx(), bounds.Dy(), format, "GoRFB"}
-	conn.Write(serverInit.encode())
+	serverInit := serverStatus{bounds.Dx(), bounds.Dy(), serverPixelFormat, "GoRFB"}
+	_, err = conn.Write(serverInit.encode())
+	return err
 }
 
-func handleConn(client *RfbClient, fbch chan<- getUpdate) {
+// handleConn serves the client until the connection or the server is shut
+// down. It returns the error, which ended the connection, if any.
+func handleConn(client *RfbClient, fbch chan<- getUpdate) error {
 	var wg sync.WaitGroup
 	var once sync.Once
 
-	initializeConnection(client.conn, client.bounds)
+	bounds, ok := client.screen()
+	if !ok {
+		return nil
+	}
+	if err := initializeConnection(client, bounds); err != nil {
+		return err
+	}
+	conn := client.state
 
-	dt := make(chan updateRect)
+	dt := make(chan trackerMsg)
 	defer close(dt)
 	outch := make(chan [][]byte)
 	defer close(outch)
@@ -438,6 +740,19 @@ func handleConn(client *RfbClient, fbch chan<- getUpdate) {
 		close(done)
 	}
 	defer once.Do(onceBody)
+	// connErr is the first error of the input and output goroutines.
+	var connErr error
+	var errOnce sync.Once
+	fail := func(err error) {
+		select {
+		case <-done:
+			// The connection was closed on purpose.
+		default:
+			if err != io.EOF {
+				errOnce.Do(func() { connErr = err })
+			}
+		}
+	}
 
 	// trigger connection shutdown, when the whole server is being stopped
 	wg.Add(1)
@@ -470,23 +785,28 @@ func handleConn(client *RfbClient, fbch chan<- getUpdate) {
 				case client.unregch <- reg:
 				}
 			}()
-			dirtyTracker(dt, fbch, outch, reg, done)
+			dirtyTracker(dt, fbch, outch, reg, bounds, conn, done)
 		}
 	}()
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		defer once.Do(onceBody)
-		clientInput(client.conn, client.mux, dt, done)
+		if err := clientInput(client.conn, client, conn, dt, done); err != nil {
+			fail(err)
+		}
 	}()
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		defer once.Do(onceBody)
-		clientOutput(client.conn, outch, done)
+		if err := clientOutput(client.conn, outch, done); err != nil {
+			fail(err)
+		}
 	}()
 
 	wg.Wait()
+	return connErr
 }
 
 func decodePixelFormat(b [16]byte) PixelFormat {
@@ -525,7 +845,7 @@ func decodeEncodings(b []byte) encodings {
 	return e
 }
 
-func updateRequest(b [9]byte, choice encodings) updateRect {
+func updateRequest(b [9]byte, choice clientEncodings, format PixelFormat) updateRect {
 	incr := b[0] == 1
 	x := int(binary.BigEndian.Uint16(b[1:3]))
 	y := int(binary.BigEndian.Uint16(b[3:5]))
@@ -533,24 +853,24 @@ func updateRequest(b [9]byte, choice encodings) updateRect {
 	h := int(binary.BigEndian.Uint16(b[7:9]))
 
 	// Send the viewport of our remote client to the dirtyTracker goroutine.
-	return updateRect{image.Rect(x, y, x+w, y+h), incr, choice}
+	return updateRect{image.Rect(x, y, x+w, y+h), incr, choice, format}
 }
 
-func ptrEvent(b [5]byte) InputEvent {
+func ptrEvent(b [5]byte, client *RfbClient) InputEvent {
 	mask := uint8(b[0])
 	x := int(binary.BigEndian.Uint16(b[1:3]))
 	y := int(binary.BigEndian.Uint16(b[3:5]))
-	return InputEvent{T: 0, Pos: image.Point{x, y}, Mask: mask}
+	return InputEvent{T: 0, Pos: image.Point{x, y}, Mask: mask, Client: client}
 }
 
-func kbdEvent(b [7]byte) InputEvent {
+func kbdEvent(b [7]byte, client *RfbClient) InputEvent {
 	downflag := uint8(b[0])
 	key := binary.BigEndian.Uint32(b[3:7])
-	return InputEvent{T: 1, Key: key, Mask: downflag}
+	return InputEvent{T: 1, Key: key, Mask: downflag, Client: client}
 }
 
-func cutEvent(b []byte) CutEvent {
-	return CutEvent{string(b)}
+func cutEvent(b []byte, client *RfbClient) CutEvent {
+	return CutEvent{Txt: decodeLatin1(b), Client: client}
 }
 
 func (f PixelFormat) encode() []byte {
@@ -623,14 +943,25 @@ func (ev InputEvent) encode() []byte {
 }
 
 func (ev CutEvent) encode() []byte {
-	b := make([]byte, 8+len(ev.Txt))
+	txt, _ := encodeLatin1(ev.Txt, CutTextReplace)
+	b := make([]byte, 8+len(txt))
 	b[0] = byte(clientCutTextReq)
-	binary.BigEndian.PutUint32(b[4:8], uint32(len(ev.Txt)))
-	copy(b[8:], ev.Txt)
+	binary.BigEndian.PutUint32(b[4:8], uint32(len(txt)))
+	copy(b[8:], txt)
 	return b
 }
 
 func (ev InputEvent) work(state *rfbMuxState, done <-chan interface{}) {
+	if ev.T == 0 {
+		// The server draws the cursor for some of the clients. Only
+		// the latest position is kept, so input is never delayed by
+		// the updater.
+		select {
+		case <-state.pointer:
+		default:
+		}
+		state.pointer <- cursorPos(ev.Pos)
+	}
 	select {
 	case <-done:
 	case state.input <- ev:
@@ -645,7 +976,7 @@ func (ev CutEvent) work(state *rfbMuxState, done <-chan interface{}) {
 }
 
 func rfbMux(ch <-chan muxMsg, serv *RfbServer) {
-	state := rfbMuxState{serv.Input, serv.Txt}
+	state := rfbMuxState{serv.Input, serv.Txt, serv.clip, serv.pointer}
 
 	for {
 		select {
@@ -667,74 +998,191 @@ func rectHeader(rect image.Rectangle, encoding int32) []byte {
 	return b
 }
 
-func encodeRaw(img image.Image, rect image.Rectangle, b [][]byte) {
-	x := rect.Min.X
-	y := rect.Min.Y
-	w := rect.Dx()
-	h := rect.Dy()
-
-	// Rectangle data
-	rawbuf := make([]byte, w*h*4)
-	for i := 0; i < h; i++ {
-		for j := 0; j < w; j++ {
-			r, g, b, a := img.At(x+j, y+i).RGBA()
-			rawbuf[i*int(w)*4+j*4] = byte(uint8(b))
-			rawbuf[i*int(w)*4+j*4+1] = byte(uint8(g))
-			rawbuf[i*int(w)*4+j*4+2] = byte(uint8(r))
-			rawbuf[i*int(w)*4+j*4+3] = byte(uint8(a))
+// encodeRect returns the header and the data of rect encoded with enc,
+// falling back to raw encoding if enc fails.
+func encodeRect(enc Encoder, img image.Image, rect image.Rectangle, format PixelFormat) [][]byte {
+	e := enc.Encoding()
+	var buf bytes.Buffer
+	err := enc.Encode(&buf, img, rect, format)
+	if err != nil {
+		if err != errLargerThanRaw {
+			log.Printf("encoding %v failed: %v", e, err)
 		}
+		e = encodingRaw
+		buf.Reset()
+		rawEncoder{}.Encode(&buf, img, rect, format)
 	}
+	return [][]byte{rectHeader(rect, e), buf.Bytes()}
+}
 
-	b[0] = rectHeader(rect, int32(encodingRaw))
-	b[1] = rawbuf
+// updateHeader returns the header of a FramebufferUpdate message with n
+// rectangles.
+func updateHeader(n int) []byte {
+	outbuf := make([]byte, 4)
+	outbuf[0] = framebufferUpdateMsg
+	outbuf[1] = 0 // padding
+	binary.BigEndian.PutUint16(outbuf[2:4], uint16(n))
+	return outbuf
 }
 
-func encodeDirty(img image.Image, dirt Dirty, choice encodings) [][]byte {
-	rs := dirt.toRects()
-	nrects := len(rs)
+// encodeDirty passes the messages answering the update request u to emit.
+// Clients supporting LastRect receive every rectangle as soon as it is
+// encoded, all other clients receive the whole update at once, since its
+// header contains the number of rectangles.
+func encodeDirty(state *updaterState, u getUpdate, emit func([][]byte)) {
+	if u.resized {
+		emit(append([][]byte{updateHeader(1)}, encodeLayout(u)...))
+		return
+	}
+	rs := u.toRects()
+	moves := u.moves
+	if !u.choice.has(encodingCopyrect) {
+		for _, m := range moves {
+			rs = append(rs, m.dstRect())
+		}
+		moves = nil
+	}
+	soft := state.cursor != nil && u.choice.cursorEncoding() == 0
+	if soft {
+		// The client copies the cursor drawn by the server along
+		// with the moved pixels.
+		c := state.cursorArea()
+		for _, m := range moves {
+			if m.src.Overlaps(c) {
+				rs = append(rs, m.dstRect())
+			}
+			if m.dstRect().Overlaps(c) {
+				rs = append(rs, c)
+			}
+		}
+	}
+	cursor := u.cursor && u.choice.cursorEncoding() != 0
 
-	if nrects == 0 {
-		return [][]byte{}
+	if len(rs) == 0 && len(moves) == 0 && !cursor {
+		return
 	}
 
-	outbytes := make([][]byte, 2*nrects+1)
-	outbuf := make([]byte, 4)
-	outbuf[0] = framebufferUpdateMsg
-	outbuf[1] = 0 // padding
-	binary.BigEndian.PutUint16(outbuf[2:4], uint16(nrects))
-	outbytes[0] = outbuf
-	for i, r := range rs {
-		// XXX implement more encodings
-		// for now just use the first encoding in the choice slice
-		if len(choice) > 0 && choice[0] == encodingRaw {
-			encodeRaw(img, r, outbytes[2*i+1:2*i+3])
-		} else {
-			// fall back to raw encoding
-			encodeRaw(img, r, outbytes[2*i+1:2*i+3])
+	outbytes := [][]byte{}
+	format := u.format
+	if format.trueColor == 0 {
+		format.cmap = state.colorMap(format)
+		if u.conn.cmap != format.cmap {
+			// The colour map has to arrive before the pixel data
+			// referring to it.
+			u.conn.cmap = format.cmap
+			outbytes = append(outbytes, format.cmap.encode())
+		}
+	}
+	rects := [][]byte{}
+	add := func(b [][]byte) {
+		rects = append(rects, b...)
+	}
+	stream := u.choice.has(encodingLastRect)
+	if stream {
+		emit(append(outbytes, updateHeader(0xffff)))
+		add = emit
+	}
+	if cursor {
+		add(state.cursor.encode(u.choice.cursorEncoding(), format))
+	}
+	// The client has to apply the moves before any of the other
+	// rectangles, since their pixels may be copied.
+	for _, m := range moves {
+		add(m.encode())
+	}
+	for _, r := range rs {
+		enc := u.conn.encoder(state, state.choose(u.choice, r))
+		if c, ok := enc.(configurer); ok {
+			c.configure(u.choice)
+		}
+		parts := []image.Rectangle{r}
+		if s, ok := enc.(splitter); ok {
+			parts = s.split(r)
+		}
+		for _, p := range parts {
+			img := image.Image(state.img)
+			if !p.In(state.img.Bounds()) {
+				img = letterbox{img}
+			}
+			if soft {
+				img = state.softCursor(img, p)
+			}
+			add(encodeRect(enc, img, p, format))
 		}
 	}
-	return outbytes
+	if stream {
+		emit([][]byte{rectHeader(image.Rectangle{}, encodingLastRect)})
+		return
+	}
+	outbytes = append(outbytes, updateHeader(len(rects)/2))
+	emit(append(outbytes, rects...))
 }
 
-func remove(ls []chan<- []image.Rectangle, a chan<- []image.Rectangle) []chan<- []image.Rectangle {
-	res := ls
-	for i, c := range ls {
-		if a == c {
-			res = append(ls[:i], ls[i+1:]...)
-			close(a)
+func remove(ls []chan<- trackerMsg, a chan<- trackerMsg) []chan<- trackerMsg {
+	res := []chan<- trackerMsg{}
+	for _, c := range ls {
+		if a != c {
+			res = append(res, c)
 		}
 	}
 	return res
 }
 
+// notify signals d to the dirtyTrackers in mylist. Avoid deadlock when any
+// of the dirtyTrackers wants to unregister.
+func (state *updaterState) notify(serv *RfbServer, mylist []chan<- trackerMsg, d trackerMsg) bool {
+	for len(mylist) > 0 {
+		select {
+		case <-serv.done:
+			return false
+		case mylist[0] <- d:
+			mylist = mylist[1:]
+		case a := <-serv.unregch:
+			state.reglist = remove(state.reglist, a)
+			mylist = remove(mylist, a)
+			close(a)
+		}
+	}
+	return true
+}
+
+// flush sends the queued messages to all the dirtyTrackers.
+func (state *updaterState) flush(serv *RfbServer) bool {
+	msgs := state.msgs
+	state.msgs = nil
+	for _, m := range msgs {
+		if !state.notify(serv, state.reglist, m) {
+			return false
+		}
+	}
+	return true
+}
+
+// release waits until the framebuffer is handed back through Relfb.
+func (state *updaterState) release(serv *RfbServer) ([]image.Rectangle, bool) {
+	for {
+		select {
+		case <-serv.done:
+			return nil, false
+		case m := <-serv.ctl:
+			m.apply(state)
+		case p := <-serv.pointer:
+			p.apply(state)
+		case d := <-serv.Relfb:
+			return d, true
+		}
+	}
+}
+
 func updater(img draw.Image, fbch <-chan getUpdate, serv *RfbServer) {
-	reglist := []chan<- []image.Rectangle{}
+	state := updaterState{img: img, encoders: builtinEncoders()}
+	state.updateColorMap()
 	defer func() {
-		for _, ch := range reglist {
+		for _, ch := range state.reglist {
 			close(ch)
 		}
 	}()
-	ch := make(chan []image.Rectangle)
+	ch := make(chan trackerMsg)
 	defer func() {
 		close(ch)
 	}()
@@ -743,38 +1191,70 @@ func updater(img draw.Image, fbch <-chan getUpdate, serv *RfbServer) {
 		select {
 		case <-serv.done:
 			return
-		case serv.Getfb <- img:
-			select {
-			case <-serv.done:
+		case serv.Getfb <- state.img:
+			d, ok := state.release(serv)
+			if !ok {
+				return
+			}
+			if state.updateColorMap() {
+				// The colours of a paletted image changed
+				// everywhere. d belongs to the application.
+				d = append(append([]image.Rectangle{}, d...), state.img.Bounds())
+			}
+			msg := damage{d, state.moves}
+			state.moves = nil
+			if state.detector != nil {
+				var found []move
+				found, msg.rects = state.detector.detect(state.img, msg.moves, d)
+				msg.moves = append(msg.moves, found...)
+			}
+			state.msgs = append(state.msgs, msg)
+			if !state.flush(serv) {
+				return
+			}
+		case p := <-serv.pointer:
+			p.apply(&state)
+			if !state.flush(serv) {
+				return
+			}
+		case m := <-serv.ctl:
+			m.apply(&state)
+			if state.updateColorMap() {
+				state.msgs = append(state.msgs, damage{rects: []image.Rectangle{state.img.Bounds()}})
+			}
+			if !state.flush(serv) {
 				return
-			case d := <-serv.Relfb:
-				// Signal the d image.Rectangle to all the
-				// dirtyTrackers. Avoid deadlock when any the
-				// dirtyTracker wants to unregister.
-				mylist := reglist[:]
-				for {
-					if len(mylist) == 0 {
-						break
-					}
-					reg := mylist[0]
-					select {
-					case <-serv.done:
-						return
-					case reg <- d:
-						mylist = mylist[1:]
-					case a := <-serv.unregch:
-						reglist = remove(reglist, a)
-						mylist = remove(mylist, a)
-					}
-				}
 			}
 		case a := <-fbch:
-			a.outch <- encodeDirty(img, a.Dirty, a.choice)
+			encodeDirty(&state, a, func(b [][]byte) {
+				a.outch <- b
+			})
+			a.outch <- nil
 		case serv.regch <- ch:
-			reglist = append(reglist, ch)
-			ch = make(chan []image.Rectangle)
+			state.reglist = append(state.reglist, ch)
+			// The framebuffer may have been resized since the
+			// client got its size.
+			msgs := []trackerMsg{newLayout{state.img.Bounds(), state.layout(), nil, false}}
+			if state.cursorSet {
+				msgs = append(msgs, cursorMsg{rect: state.cursorArea(), shape: true})
+			}
+			if state.clipOn {
+				msgs = append(msgs, clipboardOn{})
+			}
+			if state.clipboard.c != nil {
+				c := state.clipboard
+				c.offer = false
+				msgs = append(msgs, c)
+			}
+			for _, m := range msgs {
+				if !state.notify(serv, []chan<- trackerMsg{ch}, m) {
+					return
+				}
+			}
+			ch = make(chan trackerMsg)
 		case a := <-serv.unregch:
-			reglist = remove(reglist, a)
+			state.reglist = remove(state.reglist, a)
+			close(a)
 		}
 	}
 }
@@ -814,22 +1294,24 @@ func serve(port string, img draw.Image, serv *RfbServer) {
 				log.Print(err)
 				return
 			}
-			client := &RfbClient{conn, img.Bounds(), muxch, serv.regch, serv.unregch, serv.done}
+			state := &connState{encoders: make(map[int32]Encoder)}
+			client := &RfbClient{conn, state, serv.ctl, muxch, serv.regch, serv.unregch, serv.done, serv.clipOn, serv.auths, nil}
 			serv.wg.Add(1)
 			go func() {
 				defer fmt.Printf("connection finished\n")
 				defer serv.wg.Done()
 				defer conn.Close()
-				handleConn(client, fbch)
+				if err := handleConn(client, fbch); err != nil {
+					log.Print(err)
+				}
 			}()
 		}
 	}()
 }
 
-func Server(port string, img draw.Image) (*RfbServer, error) {
-	var wg sync.WaitGroup
-	var once sync.Once
-
+// Server serves img to VNC clients on port. Without options, clients do not
+// have to authenticate.
+func Server(port string, img draw.Image, opts ...Option) (*RfbServer, error) {
 	ln, err := net.Listen("tcp", port)
 	if err != nil {
 		return nil, err
@@ -838,11 +1320,35 @@ func Server(port string, img draw.Image) (*RfbServer, error) {
 	txt := make(chan CutEvent)
 	getfb := make(chan draw.Image)
 	relfb := make(chan []image.Rectangle)
-	regch := make(chan chan []image.Rectangle)
-	unregch := make(chan chan []image.Rectangle)
+	regch := make(chan chan trackerMsg)
+	unregch := make(chan chan trackerMsg)
+	ctl := make(chan updaterMsg)
 	done := make(chan interface{})
 
-	serv := &RfbServer{ln, input, txt, getfb, relfb, regch, unregch, done, wg, once}
+	serv := &RfbServer{
+		ln:      ln,
+		Input:   input,
+		Txt:     txt,
+		Getfb:   getfb,
+		Relfb:   relfb,
+		regch:   regch,
+		unregch: unregch,
+		ctl:     ctl,
+		done:    done,
+		clip:    make(chan ClipboardEvent),
+		clipOn:  make(chan interface{}),
+		pointer: make(chan cursorPos, 1),
+	}
+	for _, opt := range opts {
+		opt(serv)
+	}
+	if err := checkAuths(serv.auths); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if len(serv.auths) == 0 {
+		serv.auths = []Authenticator{NoAuth{}}
+	}
 	serv.wg.Add(1)
 	serve(port, img, serv)
 	serv.wg.Done()
@@ -851,6 +1357,7 @@ func Server(port string, img draw.Image) (*RfbServer, error) {
 		serv.wg.Wait()
 		close(input)
 		close(txt)
+		close(serv.clip)
 		close(getfb)
 		close(relfb)
 		close(regch)
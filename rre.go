@@ -0,0 +1,89 @@
+package gorfb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+)
+
+type (
+	rreEncoder   struct{}
+	correEncoder struct{}
+)
+
+// CoRRE rectangles must fit into 255 by 255 pixels, since subrectangle
+// positions and sizes are sent in a single byte.
+const correMaxSize = 255
+
+func (rreEncoder) Encoding() int32 {
+	return encodingRRE
+}
+
+func (e rreEncoder) New() Encoder {
+	return e
+}
+
+func (rreEncoder) Encode(w io.Writer, img image.Image, rect image.Rectangle, format PixelFormat) error {
+	return encodeRRE(w, img, rect, format, func(buf *bytes.Buffer, r subrect) {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint16(b[0:2], uint16(r.x))
+		binary.BigEndian.PutUint16(b[2:4], uint16(r.y))
+		binary.BigEndian.PutUint16(b[4:6], uint16(r.w))
+		binary.BigEndian.PutUint16(b[6:8], uint16(r.h))
+		buf.Write(b)
+	})
+}
+
+func (correEncoder) Encoding() int32 {
+	return encodingCoRRE
+}
+
+func (e correEncoder) New() Encoder {
+	return e
+}
+
+func (correEncoder) split(rect image.Rectangle) []image.Rectangle {
+	res := []image.Rectangle{}
+	for y := rect.Min.Y; y < rect.Max.Y; y += correMaxSize {
+		for x := rect.Min.X; x < rect.Max.X; x += correMaxSize {
+			r := image.Rect(x, y, x+correMaxSize, y+correMaxSize)
+			res = append(res, r.Intersect(rect))
+		}
+	}
+	return res
+}
+
+func (correEncoder) Encode(w io.Writer, img image.Image, rect image.Rectangle, format PixelFormat) error {
+	return encodeRRE(w, img, rect, format, func(buf *bytes.Buffer, r subrect) {
+		buf.Write([]byte{byte(r.x), byte(r.y), byte(r.w), byte(r.h)})
+	})
+}
+
+// encodeRRE writes the number of subrectangles and the background pixel,
+// followed by the subrectangles, whose geometry is written by put. It fails
+// with errLargerThanRaw, when the subrectangles take as much space as the
+// raw pixels.
+func encodeRRE(w io.Writer, img image.Image, rect image.Rectangle, format PixelFormat, put func(buf *bytes.Buffer, r subrect)) error {
+	var buf bytes.Buffer
+	px := pixels(img, rect, format)
+	bg := background(px)
+	rs := subrects(px, rect.Dx(), rect.Dy(), bg)
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(len(rs)))
+	buf.Write(b)
+	bypp := format.BytesPerPixel()
+	format.PutPixel(b, bg)
+	buf.Write(b[:bypp])
+	raw := rect.Dx() * rect.Dy() * bypp
+	for _, r := range rs {
+		format.PutPixel(b, r.p)
+		buf.Write(b[:bypp])
+		put(&buf, r)
+		if buf.Len() >= raw {
+			return errLargerThanRaw
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,300 @@
+package gorfb
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"net"
+)
+
+type (
+	// RSAAES is the RSA-AES security type of TigerVNC and RealVNC, which
+	// authenticates the client over a channel encrypted with AES-EAX,
+	// without certificates: clients check the fingerprint of Key
+	// instead. With Unencrypted set, only the authentication is
+	// encrypted (RA2ne), otherwise the whole session. AES256 selects
+	// AES-256 and SHA-256 instead of AES-128 and SHA-1.
+	//
+	// Clients send a user name and password, which are checked by Plain
+	// if set, or only a password, which is checked against Password.
+	RSAAES struct {
+		Key         *rsa.PrivateKey
+		AES256      bool
+		Unencrypted bool
+		Password    PasswordFunc
+		Plain       PlainFunc
+	}
+	// aesConn is a connection encrypted with AES-EAX. Every message is
+	// preceded by its length, and followed by the authentication tag.
+	aesConn struct {
+		net.Conn
+		in, out           cipher.AEAD
+		inNonce, outNonce [16]byte
+		buf               []byte
+	}
+)
+
+const (
+	securityRA2     = 5
+	securityRA2ne   = 6
+	securityRA256   = 129
+	securityRAne256 = 133
+)
+
+// RSA-AES sub-types
+const (
+	ra2UserPass = 1
+	ra2Pass     = 2
+)
+
+const (
+	minRSAKeyLength  = 1024
+	maxRSAKeyLength  = 8192
+	maxAESMessageLen = 8192
+)
+
+func (a RSAAES) SecurityType() uint8 {
+	switch {
+	case a.AES256 && a.Unencrypted:
+		return securityRAne256
+	case a.AES256:
+		return securityRA256
+	case a.Unencrypted:
+		return securityRA2ne
+	}
+	return securityRA2
+}
+
+// hash returns the hash function used for the session keys and the key
+// exchange hashes.
+func (a RSAAES) hash() hash.Hash {
+	if a.AES256 {
+		return sha256.New()
+	}
+	return sha1.New()
+}
+
+// encodeRSAKey returns the public key message for k.
+func encodeRSAKey(k *rsa.PublicKey) []byte {
+	size := (k.N.BitLen() + 7) / 8
+	b := make([]byte, 4+2*size)
+	binary.BigEndian.PutUint32(b, uint32(k.N.BitLen()))
+	k.N.FillBytes(b[4 : 4+size])
+	big.NewInt(int64(k.E)).FillBytes(b[4+size:])
+	return b
+}
+
+// readRSAKey reads the public key of the client, and returns it with the
+// public key message.
+func readRSAKey(r io.Reader) (*rsa.PublicKey, []byte, error) {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, nil, err
+	}
+	bits := binary.BigEndian.Uint32(b)
+	if bits < minRSAKeyLength || bits > maxRSAKeyLength {
+		return nil, nil, fmt.Errorf("Unsupported RSA key length %v", bits)
+	}
+	size := int(bits+7) / 8
+	b = append(b, make([]byte, 2*size)...)
+	if _, err := io.ReadFull(r, b[4:]); err != nil {
+		return nil, nil, err
+	}
+	e := new(big.Int).SetBytes(b[4+size:])
+	if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+		return nil, nil, errors.New("Invalid RSA key")
+	}
+	k := &rsa.PublicKey{N: new(big.Int).SetBytes(b[4 : 4+size]), E: int(e.Int64())}
+	return k, b, nil
+}
+
+// Authenticate exchanges the public keys and the random values of the
+// session keys with the client, checks the hashes of the public keys and
+// then the credentials.
+func (a RSAAES) Authenticate(conn net.Conn) (net.Conn, interface{}, error) {
+	if a.Key == nil {
+		return nil, nil, errors.New("RSA-AES is not configured")
+	}
+	serverKey := encodeRSAKey(&a.Key.PublicKey)
+	if _, err := conn.Write(serverKey); err != nil {
+		return nil, nil, err
+	}
+	pub, clientKey, err := readRSAKey(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	randomSize := 16
+	if a.AES256 {
+		randomSize = 32
+	}
+	serverRandom := make([]byte, randomSize)
+	if _, err := rand.Read(serverRandom); err != nil {
+		return nil, nil, err
+	}
+	c, err := rsa.EncryptPKCS1v15(rand.Reader, pub, serverRandom)
+	if err != nil {
+		return nil, nil, err
+	}
+	b := make([]byte, 2, 2+len(c))
+	binary.BigEndian.PutUint16(b, uint16(len(c)))
+	if _, err := conn.Write(append(b, c...)); err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, nil, err
+	}
+	if int(binary.BigEndian.Uint16(b)) != a.Key.Size() {
+		return nil, nil, errors.New("Invalid RSA-AES random")
+	}
+	c = make([]byte, a.Key.Size())
+	if _, err := io.ReadFull(conn, c); err != nil {
+		return nil, nil, err
+	}
+	clientRandom := make([]byte, randomSize)
+	if err := rsa.DecryptPKCS1v15SessionKey(rand.Reader, a.Key, c, clientRandom); err != nil {
+		return nil, nil, err
+	}
+
+	keySize := 16
+	if a.AES256 {
+		keySize = 32
+	}
+	sum := func(parts ...[]byte) []byte {
+		h := a.hash()
+		for _, p := range parts {
+			h.Write(p)
+		}
+		return h.Sum(nil)
+	}
+	in, err := newEAX(sum(serverRandom, clientRandom)[:keySize])
+	if err != nil {
+		return nil, nil, err
+	}
+	out, err := newEAX(sum(clientRandom, serverRandom)[:keySize])
+	if err != nil {
+		return nil, nil, err
+	}
+	enc := &aesConn{Conn: conn, in: in, out: out}
+
+	if _, err := enc.Write(sum(serverKey, clientKey)); err != nil {
+		return nil, nil, err
+	}
+	h := make([]byte, a.hash().Size())
+	if _, err := io.ReadFull(enc, h); err != nil {
+		return nil, nil, err
+	}
+	if subtle.ConstantTimeCompare(h, sum(clientKey, serverKey)) != 1 {
+		return nil, nil, errors.New("RSA-AES key hash mismatch")
+	}
+
+	subtype := byte(ra2Pass)
+	if a.Plain != nil {
+		subtype = ra2UserPass
+	}
+	if _, err := enc.Write([]byte{subtype}); err != nil {
+		return nil, nil, err
+	}
+	user, err := readRA2String(enc)
+	if err != nil {
+		return nil, nil, err
+	}
+	password, err := readRA2String(enc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res := net.Conn(enc)
+	if a.Unencrypted {
+		res = conn
+	}
+	if subtype == ra2UserPass {
+		if !a.Plain(conn, user, password) {
+			return res, nil, errAuthFailed
+		}
+		return res, user, nil
+	}
+	if a.Password == nil {
+		return res, nil, errAuthFailed
+	}
+	want, ok := a.Password(conn)
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(want)) != 1 {
+		return res, nil, errAuthFailed
+	}
+	return res, nil, nil
+}
+
+// readRA2String reads a user name or password, which is preceded by its
+// length.
+func readRA2String(r io.Reader) (string, error) {
+	n := make([]byte, 1)
+	if _, err := io.ReadFull(r, n); err != nil {
+		return "", err
+	}
+	b := make([]byte, n[0])
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// increment increments the nonce, a little endian counter.
+func increment(nonce *[16]byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+func (c *aesConn) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		hdr := make([]byte, 2)
+		if _, err := io.ReadFull(c.Conn, hdr); err != nil {
+			return 0, err
+		}
+		msg := make([]byte, int(binary.BigEndian.Uint16(hdr))+c.in.Overhead())
+		if _, err := io.ReadFull(c.Conn, msg); err != nil {
+			return 0, err
+		}
+		b, err := c.in.Open(nil, c.inNonce[:], msg, hdr)
+		if err != nil {
+			return 0, err
+		}
+		increment(&c.inNonce)
+		c.buf = b
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *aesConn) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		m := p
+		if len(m) > maxAESMessageLen {
+			m = m[:maxAESMessageLen]
+		}
+		b := make([]byte, 2, 2+len(m)+c.out.Overhead())
+		binary.BigEndian.PutUint16(b, uint16(len(m)))
+		b = c.out.Seal(b, c.outNonce[:], m, b[:2])
+		increment(&c.outNonce)
+		if _, err := c.Conn.Write(b); err != nil {
+			return n, err
+		}
+		n += len(m)
+		p = p[len(m):]
+	}
+	return n, nil
+}
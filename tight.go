@@ -0,0 +1,336 @@
+package gorfb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+)
+
+type (
+	// tightEncoder holds the four zlib streams of a client connection.
+	// The compression level and the JPEG quality follow the client's
+	// pseudo-encodings.
+	tightEncoder struct {
+		streams  [4]*tightStream
+		resets   byte
+		compress int
+		quality  int
+	}
+	tightStream struct {
+		buf bytes.Buffer
+		zw  *zlib.Writer
+	}
+)
+
+const (
+	tightMaxRectSize   = 65536
+	tightMaxRectWidth  = 2048
+	tightMinToCompress = 12
+	tightDefaultLevel  = 6
+)
+
+// Compression control byte
+const (
+	tightFill           = 0x80
+	tightJpeg           = 0x90
+	tightExplicitFilter = 0x40
+)
+
+const (
+	tightFilterCopy     = 0
+	tightFilterPalette  = 1
+	tightFilterGradient = 2
+)
+
+// zlib streams
+const (
+	tightStreamCopy     = 0
+	tightStreamMono     = 1
+	tightStreamIndexed  = 2
+	tightStreamGradient = 3
+)
+
+// JPEG quality for each of the quality level pseudo-encodings.
+var tightJpegQuality = [10]int{15, 29, 41, 42, 62, 77, 79, 86, 92, 100}
+
+func (*tightEncoder) Encoding() int32 {
+	return encodingTight
+}
+
+func (*tightEncoder) New() Encoder {
+	return &tightEncoder{compress: tightDefaultLevel, quality: -1}
+}
+
+func (e *tightEncoder) configure(c clientEncodings) {
+	e.quality = c.level(encodingQualityLevel0, encodingQualityLevel9)
+	level := c.level(encodingCompressLevel0, encodingCompressLevel9)
+	if level < 0 {
+		level = tightDefaultLevel
+	}
+	if level == e.compress {
+		return
+	}
+	// Restart the zlib streams, which were already used, with the new
+	// compression level, and tell the client to reset them as well.
+	e.compress = level
+	for i, s := range e.streams {
+		if s != nil {
+			e.streams[i] = nil
+			e.resets |= 1 << uint(i)
+		}
+	}
+}
+
+func (e *tightEncoder) split(rect image.Rectangle) []image.Rectangle {
+	w := rect.Dx()
+	if w > tightMaxRectWidth {
+		w = tightMaxRectWidth
+	}
+	h := tightMaxRectSize / w
+	res := []image.Rectangle{}
+	for y := rect.Min.Y; y < rect.Max.Y; y += h {
+		for x := rect.Min.X; x < rect.Max.X; x += w {
+			res = append(res, image.Rect(x, y, x+w, y+h).Intersect(rect))
+		}
+	}
+	return res
+}
+
+// control returns the compression control byte c, including the pending
+// stream resets.
+func (e *tightEncoder) control(c byte) byte {
+	c |= e.resets
+	e.resets = 0
+	return c
+}
+
+// compressData writes data with the zlib stream id, unless data is too
+// short to be compressed.
+func (e *tightEncoder) compressData(buf *bytes.Buffer, id int, data []byte) error {
+	if len(data) < tightMinToCompress {
+		buf.Write(data)
+		return nil
+	}
+	s := e.streams[id]
+	if s == nil {
+		s = &tightStream{}
+		zw, err := zlib.NewWriterLevel(&s.buf, e.compress)
+		if err != nil {
+			return err
+		}
+		s.zw = zw
+		e.streams[id] = s
+	}
+	s.buf.Reset()
+	if _, err := s.zw.Write(data); err != nil {
+		return err
+	}
+	if err := s.zw.Flush(); err != nil {
+		return err
+	}
+	putCompactLength(buf, s.buf.Len())
+	buf.Write(s.buf.Bytes())
+	return nil
+}
+
+func putCompactLength(buf *bytes.Buffer, n int) {
+	for i := 0; i < 2 && n > 0x7f; i++ {
+		buf.WriteByte(byte(n&0x7f | 0x80))
+		n >>= 7
+	}
+	buf.WriteByte(byte(n))
+}
+
+// tpixelRGB reports whether Tight sends pixels as 3 bytes in red, green,
+// blue order.
+func (f PixelFormat) tpixelRGB() bool {
+	return f.trueColor != 0 && f.bpp == 32 && f.depth == 24 &&
+		f.redMax == 255 && f.greenMax == 255 && f.blueMax == 255
+}
+
+func putTPixels(buf *bytes.Buffer, px []uint32, format PixelFormat) {
+	if !format.tpixelRGB() {
+		b := make([]byte, 4)
+		for _, p := range px {
+			format.PutPixel(b, p)
+			buf.Write(b[:format.BytesPerPixel()])
+		}
+		return
+	}
+	for _, p := range px {
+		buf.WriteByte(byte(p >> format.redShift))
+		buf.WriteByte(byte(p >> format.greenShift))
+		buf.WriteByte(byte(p >> format.blueShift))
+	}
+}
+
+func (e *tightEncoder) Encode(w io.Writer, img image.Image, rect image.Rectangle, format PixelFormat) error {
+	var buf bytes.Buffer
+	var err error
+	px := pixels(img, rect, format)
+	order, _ := colorCounts(px, 256)
+	n := len(order)
+	tp := format.BytesPerPixel() // the size of a TPIXEL
+	if format.tpixelRGB() {
+		tp = 3
+	}
+
+	switch {
+	case n == 1:
+		buf.WriteByte(e.control(tightFill))
+		putTPixels(&buf, order, format)
+	case n <= 256 && n*tp+len(px) < len(px)*tp:
+		err = e.encodePalette(&buf, px, order, rect.Dx(), rect.Dy(), format)
+	case e.quality >= 0 && format.TrueColor() && format.bpp > 8:
+		err = e.encodeJpeg(&buf, img, rect)
+	case gradientFormat(format) && smooth(px, rect.Dx(), format):
+		buf.WriteByte(e.control(tightStreamGradient<<4 | tightExplicitFilter))
+		buf.WriteByte(tightFilterGradient)
+		var data bytes.Buffer
+		putTPixels(&data, gradient(px, rect.Dx(), format), format)
+		err = e.compressData(&buf, tightStreamGradient, data.Bytes())
+	default:
+		buf.WriteByte(e.control(tightStreamCopy << 4))
+		var data bytes.Buffer
+		putTPixels(&data, px, format)
+		err = e.compressData(&buf, tightStreamCopy, data.Bytes())
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+func (e *tightEncoder) encodePalette(buf *bytes.Buffer, px, order []uint32, w, h int, format PixelFormat) error {
+	index := make(map[uint32]byte)
+	for i, p := range order {
+		index[p] = byte(i)
+	}
+	var data bytes.Buffer
+	id := tightStreamIndexed
+	if len(order) == 2 {
+		// one bit per pixel, rows are padded to whole bytes
+		id = tightStreamMono
+		for y := 0; y < h; y++ {
+			var b byte
+			for x := 0; x < w; x++ {
+				b = b<<1 | index[px[y*w+x]]
+				if x%8 == 7 {
+					data.WriteByte(b)
+					b = 0
+				}
+			}
+			if w%8 != 0 {
+				data.WriteByte(b << uint(8-w%8))
+			}
+		}
+	} else {
+		for _, p := range px {
+			data.WriteByte(index[p])
+		}
+	}
+	buf.WriteByte(e.control(byte(id<<4) | tightExplicitFilter))
+	buf.WriteByte(tightFilterPalette)
+	buf.WriteByte(byte(len(order) - 1))
+	putTPixels(buf, order, format)
+	return e.compressData(buf, id, data.Bytes())
+}
+
+func (e *tightEncoder) encodeJpeg(buf *bytes.Buffer, img image.Image, rect image.Rectangle) error {
+	rgba := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, rect.Min, draw.Src)
+	var data bytes.Buffer
+	err := jpeg.Encode(&data, rgba, &jpeg.Options{Quality: tightJpegQuality[e.quality]})
+	if err != nil {
+		return err
+	}
+	buf.WriteByte(e.control(tightJpeg))
+	putCompactLength(buf, data.Len())
+	buf.Write(data.Bytes())
+	return nil
+}
+
+// gradientFormat reports whether the gradient filter can be used with
+// format.
+func gradientFormat(format PixelFormat) bool {
+	return format.tpixelRGB() || (format.TrueColor() && format.bpp == 16)
+}
+
+// components splits the pixel value p into its colour intensities.
+func (f PixelFormat) components(p uint32) [3]int {
+	return [3]int{
+		int(p >> f.redShift & uint32(f.redMax)),
+		int(p >> f.greenShift & uint32(f.greenMax)),
+		int(p >> f.blueShift & uint32(f.blueMax)),
+	}
+}
+
+func (f PixelFormat) maxes() [3]int {
+	return [3]int{int(f.redMax), int(f.greenMax), int(f.blueMax)}
+}
+
+// gradient applies the Tight gradient filter to px, which is w pixels
+// wide: every colour intensity is replaced by its difference to the
+// prediction from the left, upper and upper left neighbours.
+func gradient(px []uint32, w int, format PixelFormat) []uint32 {
+	res := make([]uint32, len(px))
+	maxes := format.maxes()
+	at := func(x, y int) [3]int {
+		if x < 0 || y < 0 {
+			return [3]int{}
+		}
+		return format.components(px[y*w+x])
+	}
+	for i, p := range px {
+		x, y := i%w, i/w
+		v := format.components(p)
+		left, up, upleft := at(x-1, y), at(x, y-1), at(x-1, y-1)
+		var d uint32
+		for c := 0; c < 3; c++ {
+			pred := left[c] + up[c] - upleft[c]
+			if pred < 0 {
+				pred = 0
+			} else if pred > maxes[c] {
+				pred = maxes[c]
+			}
+			diff := uint32((v[c] - pred) & maxes[c])
+			switch c {
+			case 0:
+				d |= diff << format.redShift
+			case 1:
+				d |= diff << format.greenShift
+			case 2:
+				d |= diff << format.blueShift
+			}
+		}
+		res[i] = d
+	}
+	return res
+}
+
+// smooth guesses, whether the gradient filter improves compression of px:
+// the average prediction error has to be small compared to the range of
+// colour intensities.
+func smooth(px []uint32, w int, format PixelFormat) bool {
+	if len(px) < 256 {
+		return false
+	}
+	maxes := format.maxes()
+	total, limit := 0, 0
+	for _, p := range gradient(px, w, format) {
+		d := format.components(p)
+		for c := 0; c < 3; c++ {
+			e := d[c]
+			if e > maxes[c]/2 {
+				e = maxes[c] + 1 - e
+			}
+			total += e
+			limit += (maxes[c] + 1) / 32
+		}
+	}
+	return total <= limit
+}
@@ -0,0 +1,275 @@
+package gorfb
+
+import (
+	"bytes"
+	"image"
+)
+
+// subrect is a single coloured rectangle, relative to the origin of the
+// rectangle or tile it was found in.
+type subrect struct {
+	x, y, w, h int
+	p          uint32
+}
+
+// pixels returns the pixel values of rect in row-major order.
+func pixels(img image.Image, rect image.Rectangle, format PixelFormat) []uint32 {
+	px := make([]uint32, 0, rect.Dx()*rect.Dy())
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			px = append(px, format.Pixel(img.At(x, y)))
+		}
+	}
+	return px
+}
+
+// tileSize returns the size of the tile at x, y, when rect is divided
+// into tiles of n by n pixels.
+func tileSize(rect image.Rectangle, x, y, n int) (int, int) {
+	w, h := n, n
+	if rect.Dx()-x < n {
+		w = rect.Dx() - x
+	}
+	if rect.Dy()-y < n {
+		h = rect.Dy() - y
+	}
+	return w, h
+}
+
+// tile returns the pixels of the w by h sub-rectangle at x, y of px, which
+// is stride pixels wide.
+func tile(px []uint32, stride, x, y, w, h int) []uint32 {
+	t := make([]uint32, 0, w*h)
+	for i := y; i < y+h; i++ {
+		t = append(t, px[i*stride+x:i*stride+x+w]...)
+	}
+	return t
+}
+
+// colorCounts returns the distinct pixel values of px with the number of
+// their occurrences, in order of first appearance. Counting stops, once
+// more than max distinct values were found.
+func colorCounts(px []uint32, max int) ([]uint32, map[uint32]int) {
+	order := []uint32{}
+	counts := make(map[uint32]int)
+	for _, p := range px {
+		if _, ok := counts[p]; !ok {
+			if len(order) == max {
+				return append(order, p), counts
+			}
+			order = append(order, p)
+		}
+		counts[p]++
+	}
+	return order, counts
+}
+
+// background returns the most frequent pixel value of px.
+func background(px []uint32) uint32 {
+	order, counts := colorCounts(px, len(px))
+	bg := order[0]
+	for _, p := range order {
+		if counts[p] > counts[bg] {
+			bg = p
+		}
+	}
+	return bg
+}
+
+// subrects covers all pixels of the w by h pixel array px, which differ
+// from bg, with single coloured rectangles. Each rectangle is grown
+// greedily, first horizontally and then vertically.
+func subrects(px []uint32, w, h int, bg uint32) []subrect {
+	done := make([]bool, len(px))
+	res := []subrect{}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := px[y*w+x]
+			if p == bg || done[y*w+x] {
+				continue
+			}
+			sw := 1
+			for x+sw < w && px[y*w+x+sw] == p && !done[y*w+x+sw] {
+				sw++
+			}
+			sh := 1
+		grow:
+			for y+sh < h {
+				for i := x; i < x+sw; i++ {
+					if px[(y+sh)*w+i] != p || done[(y+sh)*w+i] {
+						break grow
+					}
+				}
+				sh++
+			}
+			for i := y; i < y+sh; i++ {
+				for j := x; j < x+sw; j++ {
+					done[i*w+j] = true
+				}
+			}
+			res = append(res, subrect{x, y, sw, sh, p})
+		}
+	}
+	return res
+}
+
+// runs splits px into runs of equal pixel values.
+func runs(px []uint32) []subrect {
+	res := []subrect{}
+	for i := 0; i < len(px); {
+		j := i + 1
+		for j < len(px) && px[j] == px[i] {
+			j++
+		}
+		res = append(res, subrect{w: j - i, p: px[i]})
+		i = j
+	}
+	return res
+}
+
+// runLength returns the number of bytes needed for a ZRLE run length.
+func runLength(n int) int {
+	return (n-1)/255 + 1
+}
+
+func putRunLength(buf *bytes.Buffer, n int) {
+	for n -= 1; n >= 255; n -= 255 {
+		buf.WriteByte(255)
+	}
+	buf.WriteByte(byte(n))
+}
+
+func putCPixels(buf *bytes.Buffer, px []uint32, format PixelFormat) {
+	b := make([]byte, 4)
+	n := format.cpixelSize()
+	for _, p := range px {
+		format.putCPixel(b, p)
+		buf.Write(b[:n])
+	}
+}
+
+// sameColors reports whether the pixel values a and b are the same set.
+func sameColors(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[uint32]bool)
+	for _, p := range b {
+		set[p] = true
+	}
+	for _, p := range a {
+		if !set[p] {
+			return false
+		}
+	}
+	return true
+}
+
+// rleTile writes a ZRLE or TRLE tile of w by h pixels, using the
+// subencoding, which results in the least amount of data. TRLE passes the
+// palette of the previous tile in prev, which is reused if the tile has
+// the same colours. The palette sent with the tile is returned, if any.
+func rleTile(buf *bytes.Buffer, t []uint32, w, h int, format PixelFormat, prev []uint32) []uint32 {
+	order, _ := colorCounts(t, 127)
+	if len(order) == 1 {
+		buf.WriteByte(1)
+		putCPixels(buf, order, format)
+		return nil
+	}
+
+	cp := format.cpixelSize()
+	palsize := len(order) * cp
+	reuse := prev != nil && sameColors(order, prev)
+	if reuse {
+		order, palsize = prev, 0
+	}
+	rs := runs(t)
+	sub, size := 0, w*h*cp
+	plain := 0
+	for _, r := range rs {
+		plain += cp + runLength(r.w)
+	}
+	if plain < size {
+		sub, size = 128, plain
+	}
+	bits := 0
+	switch n := len(order); {
+	case n == 2:
+		bits = 1
+	case n <= 4:
+		bits = 2
+	case n <= 16:
+		bits = 4
+	}
+	if bits > 0 {
+		packed := palsize + h*((w*bits+7)/8)
+		if packed < size {
+			sub, size = len(order), packed
+		}
+	}
+	if len(order) <= 127 {
+		palrle := palsize
+		for _, r := range rs {
+			palrle++
+			if r.w > 1 {
+				palrle += runLength(r.w)
+			}
+		}
+		if palrle < size {
+			sub, size = 128+len(order), palrle
+		}
+	}
+
+	index := make(map[uint32]byte)
+	for i, p := range order {
+		index[p] = byte(i)
+	}
+	if reuse && sub > 0 && sub < 128 {
+		buf.WriteByte(127)
+	} else if reuse && sub > 128 {
+		buf.WriteByte(129)
+	} else {
+		buf.WriteByte(byte(sub))
+		if sub != 0 && sub != 128 {
+			putCPixels(buf, order, format)
+		}
+	}
+	switch {
+	case sub == 0:
+		putCPixels(buf, t, format)
+	case sub == 128:
+		for _, r := range rs {
+			putCPixels(buf, []uint32{r.p}, format)
+			putRunLength(buf, r.w)
+		}
+	case sub < 128:
+		for y := 0; y < h; y++ {
+			var b byte
+			nbits := 0
+			for x := 0; x < w; x++ {
+				b = b<<bits | index[t[y*w+x]]
+				nbits += bits
+				if nbits == 8 {
+					buf.WriteByte(b)
+					b, nbits = 0, 0
+				}
+			}
+			if nbits > 0 {
+				buf.WriteByte(b << (8 - nbits))
+			}
+		}
+	default:
+		for _, r := range rs {
+			if r.w == 1 {
+				buf.WriteByte(index[r.p])
+			} else {
+				buf.WriteByte(index[r.p] | 128)
+				putRunLength(buf, r.w)
+			}
+		}
+	}
+	if sub == 0 || sub == 128 {
+		return nil
+	}
+	return order
+}
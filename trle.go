@@ -0,0 +1,33 @@
+package gorfb
+
+import (
+	"bytes"
+	"image"
+	"io"
+)
+
+// trleEncoder sends the same tiles as ZRLE, but 16 by 16 pixels large and
+// without compression.
+type trleEncoder struct{}
+
+func (trleEncoder) Encoding() int32 {
+	return encodingTRLE
+}
+
+func (e trleEncoder) New() Encoder {
+	return e
+}
+
+func (trleEncoder) Encode(w io.Writer, img image.Image, rect image.Rectangle, format PixelFormat) error {
+	var buf bytes.Buffer
+	var pal []uint32
+	px := pixels(img, rect, format)
+	for y := 0; y < rect.Dy(); y += 16 {
+		for x := 0; x < rect.Dx(); x += 16 {
+			tw, th := tileSize(rect, x, y, 16)
+			pal = rleTile(&buf, tile(px, rect.Dx(), x, y, tw, th), tw, th, format, pal)
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,147 @@
+package gorfb
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+type (
+	// VeNCrypt is the VeNCrypt security type, which authenticates the
+	// client within a TLS session. The sub-types offered are chosen by
+	// the fields set: the Plain sub-types if Plain is set, the Vnc
+	// sub-types if Password is set, and the None sub-types otherwise.
+	// SubTypes overrides this choice.
+	//
+	// crypto/tls does not support the anonymous cipher suites of the TLS
+	// sub-types, so all sub-types use the certificate of Config, which
+	// clients only check for the X509 sub-types.
+	VeNCrypt struct {
+		Config   *tls.Config
+		SubTypes []uint32
+		Password PasswordFunc
+		Plain    PlainFunc
+	}
+	// PlainFunc reports whether the client connected through conn may
+	// log in as user with password. user becomes the identity of the
+	// client.
+	PlainFunc func(conn net.Conn, user, password string) bool
+)
+
+const securityVeNCrypt = 19
+
+// VeNCrypt sub-types
+const (
+	VeNCryptTLSNone   = 257
+	VeNCryptTLSVnc    = 258
+	VeNCryptTLSPlain  = 259
+	VeNCryptX509None  = 260
+	VeNCryptX509Vnc   = 261
+	VeNCryptX509Plain = 262
+)
+
+// Longer user names and passwords of the Plain sub-types are refused.
+const maxPlainLength = 1024
+
+func (VeNCrypt) SecurityType() uint8 {
+	return securityVeNCrypt
+}
+
+// subTypes returns the sub-types to offer, in order of preference.
+func (v VeNCrypt) subTypes() []uint32 {
+	if v.SubTypes != nil {
+		return v.SubTypes
+	}
+	switch {
+	case v.Plain != nil && v.Password != nil:
+		return []uint32{VeNCryptX509Plain, VeNCryptX509Vnc, VeNCryptTLSPlain, VeNCryptTLSVnc}
+	case v.Plain != nil:
+		return []uint32{VeNCryptX509Plain, VeNCryptTLSPlain}
+	case v.Password != nil:
+		return []uint32{VeNCryptX509Vnc, VeNCryptTLSVnc}
+	}
+	return []uint32{VeNCryptX509None, VeNCryptTLSNone}
+}
+
+// Authenticate negotiates the version and the sub-type, does the TLS
+// handshake and authenticates the client according to the sub-type.
+func (v VeNCrypt) Authenticate(conn net.Conn) (net.Conn, interface{}, error) {
+	conn.Write([]byte{0, 2})
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, nil, err
+	}
+	if b[0] != 0 || b[1] != 2 {
+		conn.Write([]byte{0xff})
+		return nil, nil, fmt.Errorf("Unsupported VeNCrypt version %v.%v", b[0], b[1])
+	}
+	// The version is acknowledged with a 0, followed by the sub-types.
+	types := v.subTypes()
+	msg := make([]byte, 2+4*len(types))
+	msg[1] = byte(len(types))
+	for i, t := range types {
+		binary.BigEndian.PutUint32(msg[2+4*i:], t)
+	}
+	conn.Write(msg)
+	c := make([]byte, 4)
+	if _, err := io.ReadFull(conn, c); err != nil {
+		return nil, nil, err
+	}
+	chosen := binary.BigEndian.Uint32(c)
+	offered := false
+	for _, t := range types {
+		offered = offered || t == chosen
+	}
+	if !offered || chosen < VeNCryptTLSNone || chosen > VeNCryptX509Plain {
+		return nil, nil, fmt.Errorf("Unsupported VeNCrypt sub-type %v", chosen)
+	}
+	if v.Config == nil {
+		conn.Write([]byte{0})
+		return nil, nil, errors.New("TLS is not configured")
+	}
+	conn.Write([]byte{1})
+	tlsConn := tls.Server(conn, v.Config)
+	if err := tlsConn.Handshake(); err != nil {
+		return tlsConn, nil, err
+	}
+
+	switch chosen {
+	case VeNCryptTLSVnc, VeNCryptX509Vnc:
+		if v.Password == nil {
+			return tlsConn, nil, errAuthFailed
+		}
+		_, identity, err := VNCAuth{v.Password}.Authenticate(tlsConn)
+		return tlsConn, identity, err
+	case VeNCryptTLSPlain, VeNCryptX509Plain:
+		user, password, err := readPlain(tlsConn)
+		if err != nil {
+			return tlsConn, nil, err
+		}
+		if v.Plain == nil || !v.Plain(tlsConn, user, password) {
+			return tlsConn, nil, errAuthFailed
+		}
+		return tlsConn, user, nil
+	}
+	return tlsConn, nil, nil
+}
+
+// readPlain reads the user name and password of the Plain sub-types.
+func readPlain(conn net.Conn) (string, string, error) {
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return "", "", err
+	}
+	ulen := binary.BigEndian.Uint32(b[0:4])
+	plen := binary.BigEndian.Uint32(b[4:8])
+	if ulen > maxPlainLength || plen > maxPlainLength {
+		return "", "", errAuthFailed
+	}
+	c := make([]byte, ulen+plen)
+	if _, err := io.ReadFull(conn, c); err != nil {
+		return "", "", err
+	}
+	return string(c[:ulen]), string(c[ulen:]), nil
+}
@@ -0,0 +1,47 @@
+package gorfb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"image"
+	"io"
+)
+
+// zlibEncoder compresses raw pixel data with a zlib stream, which lasts
+// for the whole client connection. Since the encoding offers no way to
+// reset the stream, the compression level requested by the client is only
+// taken into account when the stream is created.
+type zlibEncoder struct {
+	buf   bytes.Buffer
+	zw    *zlib.Writer
+	level int
+}
+
+func (*zlibEncoder) Encoding() int32 {
+	return encodingZlib
+}
+
+func (*zlibEncoder) New() Encoder {
+	return &zlibEncoder{level: zlib.DefaultCompression}
+}
+
+func (e *zlibEncoder) configure(c clientEncodings) {
+	if level := c.level(encodingCompressLevel0, encodingCompressLevel9); level >= 0 {
+		e.level = level
+	}
+}
+
+func (e *zlibEncoder) Encode(w io.Writer, img image.Image, rect image.Rectangle, format PixelFormat) error {
+	if e.zw == nil {
+		zw, err := zlib.NewWriterLevel(&e.buf, e.level)
+		if err != nil {
+			return err
+		}
+		e.zw = zw
+	}
+	var data bytes.Buffer
+	if err := (rawEncoder{}).Encode(&data, img, rect, format); err != nil {
+		return err
+	}
+	return writeZlib(w, e.zw, &e.buf, data.Bytes())
+}
@@ -0,0 +1,57 @@
+package gorfb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"io"
+)
+
+// zrleEncoder keeps a single zlib stream for the whole lifetime of the
+// client connection, as required by ZRLE.
+type zrleEncoder struct {
+	buf bytes.Buffer
+	zw  *zlib.Writer
+}
+
+func (*zrleEncoder) Encoding() int32 {
+	return encodingZRLE
+}
+
+func (*zrleEncoder) New() Encoder {
+	e := &zrleEncoder{}
+	e.zw = zlib.NewWriter(&e.buf)
+	return e
+}
+
+func (e *zrleEncoder) Encode(w io.Writer, img image.Image, rect image.Rectangle, format PixelFormat) error {
+	var data bytes.Buffer
+	px := pixels(img, rect, format)
+	for y := 0; y < rect.Dy(); y += 64 {
+		for x := 0; x < rect.Dx(); x += 64 {
+			tw, th := tileSize(rect, x, y, 64)
+			rleTile(&data, tile(px, rect.Dx(), x, y, tw, th), tw, th, format, nil)
+		}
+	}
+	return writeZlib(w, e.zw, &e.buf, data.Bytes())
+}
+
+// writeZlib compresses data into the zlib stream zw, which writes to buf,
+// and sends the result prefixed by its length.
+func writeZlib(w io.Writer, zw *zlib.Writer, buf *bytes.Buffer, data []byte) error {
+	buf.Reset()
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	if err := zw.Flush(); err != nil {
+		return err
+	}
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(buf.Len()))
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}